@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Account is a swift account polled on behalf of a project.
+type Account struct {
+	Project Project
+	Prefix  string // reseller prefix, e.g. "AUTH_"
+	Name    string // account name without its prefix, the project ID for keystone accounts
+	// Primary accounts are expected to exist: when they don't, zero usage is reported.
+	Primary bool
+}
+
+func (a Account) String() string {
+	return a.Prefix + a.Name
+}
+
+// resourceID identifies the usage of the account: the project ID for primary accounts,
+// the full account name otherwise so that the accounts of a project do not share a resource.
+func (a Account) resourceID() string {
+	if a.Primary {
+		return a.Project.ID
+	}
+	return a.String()
+}
+
+// mappedAccount is an account that is not named after a keystone project.
+type mappedAccount struct {
+	Account   string // full account name, with its prefix
+	ProjectID string // project billed for its usage, the account name without prefix by default
+}
+
+// buildAccounts returns the accounts to poll: one for each project and reseller prefix,
+// followed by the mapped accounts. Only accounts of the first prefix are primary.
+func buildAccounts(projects []Project, prefixes []string, mapped []mappedAccount) []Account {
+	var accounts []Account
+	for _, p := range projects {
+		for i, prefix := range prefixes {
+			accounts = append(accounts, Account{Project: p, Prefix: prefix, Name: p.ID, Primary: i == 0})
+		}
+	}
+	for _, m := range mapped {
+		a := Account{Project: Project{ID: m.ProjectID}, Name: m.Account}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(m.Account, prefix) {
+				a.Prefix, a.Name = prefix, strings.TrimPrefix(m.Account, prefix)
+				break
+			}
+		}
+		if a.Project.ID == "" {
+			a.Project.ID = a.Name
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts
+}
+
+// readAccountsFile reads one "<account> [project_id]" entry per line,
+// ignoring blank lines and comments starting with #.
+func readAccountsFile(path string) ([]mappedAccount, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var accounts []mappedAccount
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		account, err := parseAccountLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, scanner.Err()
+}
+
+func parseAccountLine(line string) (mappedAccount, error) {
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+		return mappedAccount{Account: fields[0]}, nil
+	case 2:
+		return mappedAccount{Account: fields[0], ProjectID: fields[1]}, nil
+	}
+	return mappedAccount{}, fmt.Errorf("expecting <account> [project_id]")
+}
+
+// tagAccount records the reseller prefix of the account in the metadata of its samples,
+// and sets their resource ID, keeping the project ID for billing.
+func tagAccount(ais []AccountInfo, account Account) {
+	for i := range ais {
+		// Container samples are identified by <project ID>/<container>.
+		ais[i].ResourceID = account.resourceID() + strings.TrimPrefix(ais[i].ResourceID, account.Project.ID)
+		if ais[i].ResourceMetadata == nil {
+			ais[i].ResourceMetadata = make(map[string]string)
+		}
+		ais[i].ResourceMetadata["reseller_prefix"] = account.Prefix
+	}
+}
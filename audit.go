@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+// auditConfig selects the accounts whose container listing is summed and compared
+// with the totals of the account HEAD, which lag behind when container updates queue up.
+type auditConfig struct {
+	enabled bool
+	ratio   float64 // share of the polled accounts audited on each run
+	// Relative bytes drift above which the sums of the listing are published instead
+	// of the account totals. 0 never corrects.
+	correctThreshold float64
+}
+
+func (a auditConfig) wants() bool {
+	return a.enabled && rand.Float64() < a.ratio
+}
+
+// auditResult is the drift of an account: the listing totals minus the account totals.
+type auditResult struct {
+	account      string
+	bytesDrift   int64
+	objectsDrift int64
+	relative     float64 // absolute bytes drift over the account bytes
+	corrected    bool
+}
+
+// auditAccount compares the totals of the account samples with the sums of its containers,
+// correcting the samples when the drift passes the threshold.
+// ok is false when the account samples do not include the sizes or object counts.
+func auditAccount(conf auditConfig, account Account, ais []AccountInfo, containers []containerInfo) (res auditResult, ok bool) {
+	size, objects := -1, -1
+	for i, ai := range ais {
+		if _, ok := ai.ResourceMetadata["storage_policy"]; ok {
+			continue
+		}
+		switch ai.CounterName {
+		case availableMeters[0].Name:
+			size = i
+		case availableMeters[1].Name:
+			objects = i
+		}
+	}
+	if size < 0 || objects < 0 {
+		return res, false
+	}
+	accountBytes, err := strconv.ParseInt(ais[size].CounterVolume, 10, 64)
+	if err != nil {
+		return res, false
+	}
+	accountObjects, err := strconv.ParseInt(ais[objects].CounterVolume, 10, 64)
+	if err != nil {
+		return res, false
+	}
+	var listingBytes, listingObjects int64
+	for _, c := range containers {
+		listingBytes += c.Bytes
+		listingObjects += c.Count
+	}
+
+	res = auditResult{
+		account:      account.String(),
+		bytesDrift:   listingBytes - accountBytes,
+		objectsDrift: listingObjects - accountObjects,
+	}
+	if accountBytes > 0 {
+		res.relative = float64(abs(res.bytesDrift)) / float64(accountBytes)
+	} else if res.bytesDrift != 0 {
+		res.relative = 1
+	}
+	if res.bytesDrift != 0 || res.objectsDrift != 0 {
+		log.Infof("Account %s drifts from its containers by %d bytes (%.2f%%) and %d objects",
+			res.account, res.bytesDrift, 100*res.relative, res.objectsDrift)
+	}
+	if conf.correctThreshold > 0 && res.relative > conf.correctThreshold {
+		ais[size].CounterVolume = strconv.FormatInt(listingBytes, 10)
+		ais[objects].CounterVolume = strconv.FormatInt(listingObjects, 10)
+		for _, i := range []int{size, objects} {
+			if ais[i].ResourceMetadata == nil {
+				ais[i].ResourceMetadata = make(map[string]string)
+			}
+			ais[i].ResourceMetadata["audit_corrected"] = "true"
+		}
+		res.corrected = true
+		log.Warnf("Publishing the container sums of account %s instead of its totals", res.account)
+	}
+	return res, true
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// auditReport aggregates the audits of a region.
+type auditReport struct {
+	Audited      int
+	Drifted      int // accounts with a drift of bytes or objects
+	Corrected    int
+	BytesDrift   int64 // sum of the absolute drifts
+	ObjectsDrift int64
+	Drifts       []auditResult
+}
+
+func (r *auditReport) add(res auditResult) {
+	r.Audited++
+	if res.bytesDrift == 0 && res.objectsDrift == 0 {
+		return
+	}
+	r.Drifted++
+	r.BytesDrift += abs(res.bytesDrift)
+	r.ObjectsDrift += abs(res.objectsDrift)
+	if res.corrected {
+		r.Corrected++
+	}
+	r.Drifts = append(r.Drifts, res)
+}
+
+func (r auditReport) Publish(gf *graphite.Graphite, region string) {
+	gf.SimpleSend(fmt.Sprintf("%v.audit.audited", region), fmt.Sprintf("%d", r.Audited))
+	gf.SimpleSend(fmt.Sprintf("%v.audit.drifted", region), fmt.Sprintf("%d", r.Drifted))
+	gf.SimpleSend(fmt.Sprintf("%v.audit.corrected", region), fmt.Sprintf("%d", r.Corrected))
+	gf.SimpleSend(fmt.Sprintf("%v.audit.bytesdrift", region), fmt.Sprintf("%d", r.BytesDrift))
+	gf.SimpleSend(fmt.Sprintf("%v.audit.objectsdrift", region), fmt.Sprintf("%d", r.ObjectsDrift))
+	for _, d := range r.Drifts {
+		account := strings.Replace(d.account, ".", "_", -1)
+		gf.SimpleSend(fmt.Sprintf("%v.audit.accounts.%v.bytesdrift", region, account), fmt.Sprintf("%d", d.bytesDrift))
+		gf.SimpleSend(fmt.Sprintf("%v.audit.accounts.%v.objectsdrift", region, account), fmt.Sprintf("%d", d.objectsDrift))
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	tokens2 "github.com/gophercloud/gophercloud/openstack/identity/v2/tokens"
+	tokens3 "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	"github.com/pkg/errors"
+)
+
+// Supported authentication modes.
+const (
+	authV1                      = "v1" // swift tempauth, without keystone
+	authV2Password              = "v2password"
+	authV3Password              = "v3password"
+	authV3Token                 = "v3token"
+	authV3ApplicationCredential = "v3applicationcredential"
+)
+
+type openstackCreds struct {
+	AuthType    string
+	AuthOptions gophercloud.AuthOptions
+	// Only used by authV3ApplicationCredential.
+	ApplicationCredentialID     string
+	ApplicationCredentialSecret string
+}
+
+// applicationCredential builds the v3 token request of the application_credential method,
+// which the vendored gophercloud does not know about. Application credentials carry their own scope.
+type applicationCredential struct {
+	ID     string
+	Secret string
+}
+
+func (a applicationCredential) ToTokenV3CreateMap(map[string]interface{}) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"application_credential"},
+				"application_credential": map[string]string{
+					"id":     a.ID,
+					"secret": a.Secret,
+				},
+			},
+		},
+	}, nil
+}
+
+func (a applicationCredential) ToTokenV3ScopeMap() (map[string]interface{}, error) { return nil, nil }
+
+func (a applicationCredential) CanReauth() bool { return true }
+
+// session holds the keystone token shared by the workers of every run.
+// The token is renewed when it gets close to expiry or when it is rejected.
+type session struct {
+	mu            sync.Mutex
+	creds         openstackCreds
+	refreshMargin time.Duration
+
+	provider *gophercloud.ProviderClient
+	idClient *gophercloud.ServiceClient
+	tokenID  string
+	expires  time.Time
+	catalog  []catalogEntry
+
+	httpClient http.Client
+}
+
+func newSession(creds openstackCreds, refreshMargin time.Duration) *session {
+	return &session{creds: creds, refreshMargin: refreshMargin}
+}
+
+// authenticate gets a new token. Must be called with s.mu held.
+func (s *session) authenticate() error {
+	if s.creds.AuthType == authV1 {
+		auth, err := authenticateV1(&s.httpClient, s.creds)
+		if err != nil {
+			return errors.Wrapf(err, "Failed authenticating with %s", s.creds.AuthType)
+		}
+		s.tokenID, s.expires, s.catalog = auth.tokenID, auth.expires, auth.catalog
+		log.Infof("Authenticated with %s, token expires at %v", s.creds.AuthType, s.expires)
+		return nil
+	}
+	provider, err := openstack.NewClient(s.creds.AuthOptions.IdentityEndpoint)
+	if err != nil {
+		return errors.Wrap(err, "Failed creating provider")
+	}
+	var auth authResult
+	if s.creds.AuthType == authV2Password {
+		auth, err = authenticateV2(provider, s.creds)
+	} else {
+		auth, err = authenticateV3(provider, s.creds)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed authenticating with %s", s.creds.AuthType)
+	}
+	provider.TokenID = auth.tokenID
+
+	s.provider, s.idClient = provider, auth.idClient
+	s.tokenID, s.expires, s.catalog = auth.tokenID, auth.expires, auth.catalog
+	log.Infof("Authenticated with %s, token expires at %v", s.creds.AuthType, s.expires)
+	return nil
+}
+
+type authResult struct {
+	idClient *gophercloud.ServiceClient
+	tokenID  string
+	expires  time.Time
+	catalog  []catalogEntry
+}
+
+// v1Expiry is assumed when the auth middleware does not say when the token expires.
+const v1Expiry = time.Hour
+
+// authenticateV1 exchanges a user and key for a token and the storage URL of the user's account.
+// The storage URL is the only entry of the catalog, with an empty region.
+func authenticateV1(client *http.Client, creds openstackCreds) (authResult, error) {
+	var auth authResult
+	req, err := http.NewRequest("GET", creds.AuthOptions.IdentityEndpoint, nil)
+	if err != nil {
+		return auth, err
+	}
+	req.Header.Set("User-Agent", gophercloud.DefaultUserAgent)
+	req.Header.Set("X-Auth-User", creds.AuthOptions.Username)
+	req.Header.Set("X-Auth-Key", creds.AuthOptions.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		return auth, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return auth, fmt.Errorf("GET %s: unexpected status %s", creds.AuthOptions.IdentityEndpoint, resp.Status)
+	}
+	auth.tokenID = resp.Header.Get("X-Auth-Token")
+	storageURL := resp.Header.Get("X-Storage-Url")
+	if auth.tokenID == "" || storageURL == "" {
+		return auth, fmt.Errorf("missing X-Auth-Token or X-Storage-Url in the response")
+	}
+	auth.expires = time.Now().Add(v1Expiry)
+	if seconds, err := strconv.Atoi(resp.Header.Get("X-Auth-Token-Expires")); err == nil {
+		auth.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	for _, eInterface := range []string{"public", "internal", "admin"} {
+		auth.catalog = append(auth.catalog,
+			catalogEntry{Type: "object-store", Interface: eInterface, URL: storageURL})
+	}
+	return auth, nil
+}
+
+func authenticateV2(provider *gophercloud.ProviderClient, creds openstackCreds) (authResult, error) {
+	var auth authResult
+	idClient, err := openstack.NewIdentityV2(provider, gophercloud.EndpointOpts{})
+	if err != nil {
+		return auth, err
+	}
+	result := tokens2.Create(idClient, creds.AuthOptions)
+	token, err := result.ExtractToken()
+	if err != nil {
+		return auth, err
+	}
+	catalog, err := result.ExtractServiceCatalog()
+	if err != nil {
+		return auth, err
+	}
+	auth = authResult{idClient: idClient, tokenID: token.ID, expires: token.ExpiresAt}
+	for _, service := range catalog.Entries {
+		for _, e := range service.Endpoints {
+			auth.catalog = append(auth.catalog,
+				catalogEntry{Type: service.Type, Region: e.Region, Interface: "public", URL: e.PublicURL},
+				catalogEntry{Type: service.Type, Region: e.Region, Interface: "internal", URL: e.InternalURL},
+				catalogEntry{Type: service.Type, Region: e.Region, Interface: "admin", URL: e.AdminURL})
+		}
+	}
+	// Keystone v2 only lists every tenant on its admin endpoint.
+	for _, e := range auth.catalog {
+		if e.Type == "identity" && e.Interface == "admin" && e.URL != "" {
+			auth.idClient = &gophercloud.ServiceClient{ProviderClient: provider, Endpoint: gophercloud.NormalizeURL(e.URL)}
+			return auth, nil
+		}
+	}
+	log.Warnf("No admin identity endpoint in the catalog, listing tenants through %s", idClient.Endpoint)
+	return auth, nil
+}
+
+func authenticateV3(provider *gophercloud.ProviderClient, creds openstackCreds) (authResult, error) {
+	var auth authResult
+	idClient, err := openstack.NewIdentityV3(provider, gophercloud.EndpointOpts{})
+	if err != nil {
+		return auth, err
+	}
+	var opts tokens3.AuthOptionsBuilder
+	switch creds.AuthType {
+	case authV3Password, authV3Token:
+		authOptions := creds.AuthOptions
+		opts = &authOptions
+	case authV3ApplicationCredential:
+		opts = applicationCredential{ID: creds.ApplicationCredentialID, Secret: creds.ApplicationCredentialSecret}
+	default:
+		return auth, fmt.Errorf("unknown auth type %s", creds.AuthType)
+	}
+	result := tokens3.Create(idClient, opts)
+	token, err := result.ExtractToken()
+	if err != nil {
+		return auth, err
+	}
+	catalog, err := result.ExtractServiceCatalog()
+	if err != nil {
+		return auth, err
+	}
+	auth = authResult{idClient: idClient, tokenID: token.ID, expires: token.ExpiresAt}
+	for _, service := range catalog.Entries {
+		for _, e := range service.Endpoints {
+			auth.catalog = append(auth.catalog,
+				catalogEntry{Type: service.Type, Region: e.Region, Interface: e.Interface, URL: e.URL})
+		}
+	}
+	return auth, nil
+}
+
+// token returns a token valid for at least refreshMargin, authenticating if needed.
+func (s *session) token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokenID == "" || time.Now().Add(s.refreshMargin).After(s.expires) {
+		if err := s.authenticate(); err != nil {
+			return "", err
+		}
+	}
+	return s.tokenID, nil
+}
+
+// reauth renews the token after it was rejected, unless it already changed since stale was handed out.
+func (s *session) reauth(stale string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokenID != stale {
+		return nil
+	}
+	log.Info("Token rejected, re-authenticating")
+	return s.authenticate()
+}
+
+// identity returns the client of the identity service the session authenticated against.
+func (s *session) identity() (*gophercloud.ServiceClient, error) {
+	if _, err := s.token(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idClient == nil {
+		return nil, fmt.Errorf("No identity service with auth type %s", s.creds.AuthType)
+	}
+	return s.idClient, nil
+}
+
+// do sends req authenticated with the session token. If the token is rejected,
+// the session re-authenticates and the request is sent once more.
+func (s *session) do(req *http.Request, client *http.Client) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		token, err := s.token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Auth-Token", token)
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || retried || req.Body != nil {
+			return resp, err
+		}
+		resp.Body.Close()
+		if err := s.reauth(token); err != nil {
+			return nil, errors.Wrap(err, "Failed re-authenticating")
+		}
+	}
+}
+
+// v3 catalog of the current token, from GET /v3/auth/catalog.
+type tokenCatalog struct {
+	Catalog []struct {
+		Type      string `json:"type"`
+		Endpoints []struct {
+			Region    string `json:"region"`
+			RegionID  string `json:"region_id"`
+			Interface string `json:"interface"`
+			URL       string `json:"url"`
+		} `json:"endpoints"`
+	} `json:"catalog"`
+}
+
+// refreshCatalog fetches the catalog again instead of keeping the one returned with the
+// token, which is reused across runs. v2 has no catalog API so the token is renewed,
+// and the v1 catalog never changes.
+func (s *session) refreshCatalog() error {
+	switch s.creds.AuthType {
+	case authV1:
+		return nil
+	case authV2Password:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.authenticate()
+	}
+	body, err := serviceGet(s, "auth/catalog")
+	if err != nil {
+		return errors.Wrap(err, "Could not get catalog")
+	}
+	var c tokenCatalog
+	if err := json.Unmarshal(body, &c); err != nil {
+		return errors.Wrap(err, "Failed unmarshalling catalog")
+	}
+	var catalog []catalogEntry
+	for _, service := range c.Catalog {
+		for _, e := range service.Endpoints {
+			region := e.Region
+			if region == "" {
+				region = e.RegionID
+			}
+			catalog = append(catalog, catalogEntry{Type: service.Type, Region: region, Interface: e.Interface, URL: e.URL})
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.catalog = catalog
+	return nil
+}
+
+// serviceCatalog returns the catalog returned with the current token.
+func (s *session) serviceCatalog() ([]catalogEntry, error) {
+	if _, err := s.token(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.catalog, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Where the object-store endpoints are looked up.
+const (
+	endpointSourceCatalog = "catalog" // catalog returned with the token
+	endpointSourceAPI     = "api"     // keystone /services and /endpoints, needs admin rights
+)
+
+// catalogEntry is one endpoint of the service catalog returned with a token.
+type catalogEntry struct {
+	Type      string
+	Region    string
+	Interface string
+	URL       string
+}
+
+// catalogEndpoint returns the URL of the single endpoint of serviceType in region with the given interface.
+func catalogEndpoint(catalog []catalogEntry, serviceType, region, eInterface string) (string, error) {
+	var result []string
+	for _, e := range catalog {
+		if e.Type == serviceType && e.Region == region && e.Interface == eInterface && e.URL != "" {
+			result = append(result, e.URL)
+		}
+	}
+	if len(result) > 1 {
+		return "", fmt.Errorf("Multiple %s endpoints in the catalog for region %s and interface %s: %v", serviceType, region, eInterface, result)
+	}
+	if len(result) < 1 {
+		return "", fmt.Errorf("No %s endpoint in the catalog for region %s and interface %s", serviceType, region, eInterface)
+	}
+	return result[0], nil
+}
+
+// catalogRegions returns the sorted regions having an endpoint of serviceType with the given interface.
+func catalogRegions(catalog []catalogEntry, serviceType, eInterface string) []string {
+	seen := make(map[string]bool)
+	var regions []string
+	for _, e := range catalog {
+		if e.Type == serviceType && e.Interface == eInterface && e.URL != "" && !seen[e.Region] {
+			seen[e.Region] = true
+			regions = append(regions, e.Region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// swiftBaseURL strips the API version and account from an object-store URL:
+// catalog URLs point to the account of the token's project.
+func swiftBaseURL(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	if i := strings.Index(url, "/v1/"); i >= 0 {
+		return url[:i]
+	}
+	return strings.TrimSuffix(url, "/v1")
+}
+
+// resolveObjectStoreURL returns the base URL of swift in region.
+func resolveObjectStoreURL(conf config, region regionConfig, sess *session) (string, error) {
+	if region.ObjectStoreURL != "" {
+		return swiftBaseURL(region.ObjectStoreURL), nil
+	}
+	if conf.EndpointSource == endpointSourceAPI {
+		url, err := getEndpoint(sess, "object-store", region.Name, conf.EndpointInterface)
+		return swiftBaseURL(url), err
+	}
+	catalog, err := sess.serviceCatalog()
+	if err != nil {
+		return "", err
+	}
+	catalogRegion := region.Name
+	if conf.Credentials.Openstack.AuthType == authV1 {
+		// The v1 catalog only holds the storage URL of the authenticated account.
+		catalogRegion = ""
+	}
+	url, err := catalogEndpoint(catalog, "object-store", catalogRegion, conf.EndpointInterface)
+	return swiftBaseURL(url), err
+}
+
+// objectStoreRegions returns the regions having an object-store endpoint.
+// The catalog is fetched again so that regions changed in keystone are seen on the next run.
+func objectStoreRegions(conf config, sess *session) ([]string, error) {
+	if conf.EndpointSource == endpointSourceAPI {
+		return getRegions(sess, "object-store", conf.EndpointInterface)
+	}
+	if err := sess.refreshCatalog(); err != nil {
+		return nil, err
+	}
+	catalog, err := sess.serviceCatalog()
+	if err != nil {
+		return nil, err
+	}
+	return catalogRegions(catalog, "object-store", conf.EndpointInterface), nil
+}
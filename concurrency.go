@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How often the concurrency controller reconsiders the number of workers.
+const concurrencyAdjustInterval = time.Second
+
+// concurrencyController bounds the number of workers polling swift at once.
+// The limit moves between min and max during a run: it backs off when the proxies
+// answer 5xx/429 or slow down, and grows while the remaining projects would not
+// be polled before the deadline. An interval without any completed request while
+// requests are in flight counts as a slowdown.
+type concurrencyController struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	min, max int
+	limit    int
+	active   int
+	peak     int
+
+	remaining int
+	// Feedback gathered since the last adjustment.
+	done      int
+	throttled int
+	latency   time.Duration
+	// Exponentially weighted average of the request latency, used as baseline.
+	baseline time.Duration
+}
+
+func newConcurrencyController(min, max, initial, projects int) *concurrencyController {
+	if initial < min {
+		initial = min
+	}
+	if initial > max {
+		initial = max
+	}
+	c := &concurrencyController{min: min, max: max, limit: initial, peak: initial, remaining: projects}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire blocks until the worker is allowed to send a request.
+func (c *concurrencyController) acquire() {
+	c.mu.Lock()
+	for c.active >= c.limit {
+		c.cond.Wait()
+	}
+	c.active++
+	c.mu.Unlock()
+}
+
+func (c *concurrencyController) release() {
+	c.mu.Lock()
+	c.active--
+	c.remaining--
+	c.cond.Signal()
+	c.mu.Unlock()
+}
+
+// observe records the outcome of a request. status is 0 when no response was received.
+func (c *concurrencyController) observe(status int, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done++
+	c.latency += latency
+	if status == 0 || status == 429 || status >= 500 {
+		c.throttled++
+	}
+}
+
+// adjust updates the limit from the feedback gathered over the last interval.
+func (c *concurrencyController) adjust(interval, timeLeft time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var avg time.Duration
+	if c.done > 0 {
+		avg = c.latency / time.Duration(c.done)
+	}
+	limit := c.limit
+	switch {
+	case c.throttled > 0:
+		limit = limit / 2
+	case c.baseline > 0 && avg > c.baseline*3/2:
+		limit--
+	case c.done == 0 && c.active > 0:
+		// Latency is only observed when requests complete: none completing while
+		// some are in flight is the slowest answer a proxy can give.
+		limit--
+	case c.remaining > 0 && (c.done == 0 || time.Duration(c.remaining)*interval/time.Duration(c.done) > timeLeft):
+		step := limit / 4
+		if step < 1 {
+			step = 1
+		}
+		limit += step
+	}
+	if limit < c.min {
+		limit = c.min
+	}
+	if limit > c.max {
+		limit = c.max
+	}
+	if limit != c.limit {
+		log.Debugf("Concurrency changed from %d to %d (%d requests, %d throttled, avg latency %v)",
+			c.limit, limit, c.done, c.throttled, avg)
+		c.limit = limit
+		c.cond.Broadcast()
+	}
+	if limit > c.peak {
+		c.peak = limit
+	}
+
+	if avg > 0 {
+		if c.baseline == 0 {
+			c.baseline = avg
+		} else {
+			c.baseline = (c.baseline*4 + avg) / 5
+		}
+	}
+	c.done, c.throttled, c.latency = 0, 0, 0
+}
+
+// current returns the current and peak limits.
+func (c *concurrencyController) current() (limit, peak int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit, c.peak
+}
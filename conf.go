@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"time"
@@ -14,29 +15,65 @@ import (
 
 var log = logrus.New()
 
-func checkConfigFile() error {
-	mandatoryKeys := []string{"credentials.openstack.keystone_uri",
+// Keys needed by each authentication mode.
+var authKeys = map[string][]string{
+	authV1: {"credentials.openstack.auth_url",
+		"credentials.openstack.swift_conso_user",
+		"credentials.openstack.auth_key"},
+	authV2Password: {"credentials.openstack.keystone_uri",
+		"credentials.openstack.swift_conso_user",
+		"credentials.openstack.swift_conso_password",
+		"credentials.openstack.swift_conso_tenant"},
+	authV3Password: {"credentials.openstack.keystone_uri",
 		"credentials.openstack.swift_conso_user",
 		"credentials.openstack.swift_conso_password",
 		"credentials.openstack.swift_conso_tenant",
-		"credentials.openstack.swift_conso_domain",
-		"credentials.rabbit.host",
-		"credentials.rabbit.user",
-		"credentials.rabbit.password",
-		"credentials.rabbit.exchange",
-		"credentials.rabbit.routing_key",
-		"credentials.rabbit.vhost",
-		"credentials.rabbit.queue",
-		"timeout",
-		"region",
+		"credentials.openstack.swift_conso_domain"},
+	authV3Token: {"credentials.openstack.keystone_uri",
+		"credentials.openstack.token",
+		"credentials.openstack.swift_conso_tenant_id"},
+	authV3ApplicationCredential: {"credentials.openstack.keystone_uri",
+		"credentials.openstack.application_credential_id",
+		"credentials.openstack.application_credential_secret"},
+}
+
+func checkConfigFile() error {
+	viper.SetDefault("credentials.openstack.auth_type", authV3Password)
+	authType := viper.GetString("credentials.openstack.auth_type")
+	keys, ok := authKeys[authType]
+	if !ok {
+		return fmt.Errorf("Unknown credentials.openstack.auth_type %s", authType)
+	}
+	mandatoryKeys := append([]string{"timeout",
 		"workers",
-		"log_level"}
+		"log_level"}, keys...)
 
 	for _, key := range mandatoryKeys {
 		if !viper.IsSet(key) {
 			return fmt.Errorf("Incomplete configuration. Missing key %s", key)
 		}
 	}
+	if !viper.IsSet("region") && !viper.IsSet("regions") && !viper.GetBool("region_discovery") {
+		return fmt.Errorf("Incomplete configuration. Missing key region, regions or region_discovery")
+	}
+	if authType == authV1 {
+		if viper.GetBool("region_discovery") {
+			return fmt.Errorf("region_discovery needs keystone")
+		}
+		if !viper.IsSet("accounts") && !viper.IsSet("accounts_file") {
+			return fmt.Errorf("Incomplete configuration. Missing key accounts or accounts_file")
+		}
+	}
+	viper.SetDefault("endpoint_source", endpointSourceCatalog)
+	switch viper.GetString("endpoint_source") {
+	case endpointSourceCatalog:
+	case endpointSourceAPI:
+		if authType == authV2Password || authType == authV1 {
+			return fmt.Errorf("endpoint_source %s needs keystone v3", endpointSourceAPI)
+		}
+	default:
+		return fmt.Errorf("Unknown endpoint_source %s", viper.GetString("endpoint_source"))
+	}
 	return nil
 }
 
@@ -49,24 +86,276 @@ type rabbitCreds struct {
 	RoutingKey string
 	URI        string
 	Queue      string
+	// Envelope of the messages, none, 1.0 or 2.0, and secret signing the samples.
+	Envelope       string
+	MeteringSecret string
+	// Mode is rpc to cast to the collectors through Exchange, or notification to send
+	// oslo notifications to NotificationExchange with the key <NotificationTopic>.<Priority>.
+	Mode                 string
+	NotificationExchange string
+	NotificationTopic    string
+	EventType            string
+	PublisherID          string
+	Priority             string
+}
+
+func (r *rabbitCreds) setURI() {
+	r.URI = strings.Join([]string{"amqp://", r.User, ":", r.Password, "@", r.Host, "/", r.Vhost}, "")
+}
+
+// regionConfig holds the settings used to poll one region.
+type regionConfig struct {
+	Name    string
+	Timeout time.Duration
+	Workers int
+	// Static swift URL, overriding the one found in keystone.
+	ObjectStoreURL string
+	// Bounds of the number of concurrent workers, both equal Workers unless set.
+	MinWorkers int
+	MaxWorkers int
+	Rabbit     rabbitCreds
+	// Backend is swift, rgw or ring. RGWEndpoint is the radosgw URL of rgw regions,
+	// AccountRing the account.ring.gz of ring regions.
+	Backend     string
+	RGWEndpoint string
+	AccountRing string
+	// Storage nodes queried for recon, taken from the devices of ReconRing unless listed.
+	ReconNodes []string
+	ReconRing  string
+}
+
+// readRegions parses the regions list. Each entry needs a name and may override
+// the global timeout, workers and any of the rabbit credentials:
+//
+//	regions:
+//	  - name: fr1
+//	    workers: 20
+//	    rabbit:
+//	      host: "fr1-queue.service"
+func readRegions(defaults regionConfig) ([]regionConfig, error) {
+	if !viper.IsSet("regions") {
+		return []regionConfig{defaults}, nil
+	}
+	entries, ok := viper.Get("regions").([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("regions must be a list")
+	}
+	var regions []regionConfig
+	for _, entry := range entries {
+		settings, ok := entry.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("regions entries must be maps")
+		}
+		region := defaults
+		region.Name = ""
+		if _, ok := settings["workers"]; ok {
+			// Without explicit bounds, the region polls with a fixed number of workers.
+			region.MinWorkers, region.MaxWorkers = 0, 0
+		}
+		for k, v := range settings {
+			value := fmt.Sprint(v)
+			var err error
+			switch fmt.Sprint(k) {
+			case "name":
+				region.Name = value
+			case "object_store_url":
+				region.ObjectStoreURL = value
+			case "backend":
+				region.Backend = value
+			case "rgw_endpoint":
+				region.RGWEndpoint = value
+			case "account_ring":
+				region.AccountRing = value
+			case "recon_nodes":
+				region.ReconNodes, err = stringList(v)
+			case "recon_ring":
+				region.ReconRing = value
+			case "timeout":
+				region.Timeout, err = time.ParseDuration(value)
+			case "workers":
+				region.Workers, err = strconv.Atoi(value)
+			case "min_workers":
+				region.MinWorkers, err = strconv.Atoi(value)
+			case "max_workers":
+				region.MaxWorkers, err = strconv.Atoi(value)
+			case "rabbit":
+				err = overrideRabbit(&region.Rabbit, v)
+			default:
+				err = fmt.Errorf("unknown key %v", k)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad setting %v for region %v", k, region.Name)
+			}
+		}
+		if region.Name == "" {
+			return nil, fmt.Errorf("Missing name in regions entry")
+		}
+		if region.MinWorkers == 0 {
+			region.MinWorkers = region.Workers
+		}
+		if region.MaxWorkers == 0 {
+			region.MaxWorkers = region.Workers
+		}
+		if err := region.checkWorkers(); err != nil {
+			return nil, errors.Wrapf(err, "Bad workers for region %v", region.Name)
+		}
+		if err := region.checkBackend(); err != nil {
+			return nil, errors.Wrapf(err, "Bad backend for region %v", region.Name)
+		}
+		region.Rabbit.setURI()
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+func (r *regionConfig) checkWorkers() error {
+	if r.MinWorkers < 1 || r.MinWorkers > r.MaxWorkers {
+		return fmt.Errorf("expecting 1 <= min_workers (%d) <= max_workers (%d)", r.MinWorkers, r.MaxWorkers)
+	}
+	return nil
+}
+
+func (r *regionConfig) checkBackend() error {
+	switch r.Backend {
+	case backendSwift:
+	case backendRGW:
+		if r.RGWEndpoint == "" {
+			return fmt.Errorf("rgw_endpoint is needed with backend %s", backendRGW)
+		}
+	case backendRing:
+		if r.AccountRing == "" {
+			return fmt.Errorf("account_ring is needed with backend %s", backendRing)
+		}
+	default:
+		return fmt.Errorf("unknown backend %s", r.Backend)
+	}
+	return nil
+}
+
+func stringList(v interface{}) ([]string, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expecting a list")
+	}
+	var list []string
+	for _, item := range items {
+		list = append(list, fmt.Sprint(item))
+	}
+	return list, nil
+}
+
+func checkEnvelope(envelope string) error {
+	switch envelope {
+	case envelopeNone, envelopeV1, envelopeV2:
+		return nil
+	}
+	return fmt.Errorf("unknown envelope %s, expected %s, %s or %s", envelope, envelopeNone, envelopeV1, envelopeV2)
+}
+
+func checkRabbitMode(mode string) error {
+	switch mode {
+	case rabbitModeRPC, rabbitModeNotification:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %s, expected %s or %s", mode, rabbitModeRPC, rabbitModeNotification)
+}
+
+func checkPriority(priority string) error {
+	for _, p := range notificationPriorities {
+		if priority == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown priority %s, expected one of %s", priority, strings.Join(notificationPriorities, ", "))
+}
+
+func overrideRabbit(rabbit *rabbitCreds, v interface{}) error {
+	settings, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("rabbit must be a map")
+	}
+	for k, v := range settings {
+		value := fmt.Sprint(v)
+		switch fmt.Sprint(k) {
+		case "host":
+			rabbit.Host = value
+		case "user":
+			rabbit.User = value
+		case "password":
+			rabbit.Password = value
+		case "vhost":
+			rabbit.Vhost = value
+		case "exchange":
+			rabbit.Exchange = value
+		case "routing_key":
+			rabbit.RoutingKey = value
+		case "queue":
+			rabbit.Queue = value
+		case "envelope":
+			if err := checkEnvelope(value); err != nil {
+				return err
+			}
+			rabbit.Envelope = value
+		case "metering_secret":
+			rabbit.MeteringSecret = value
+		case "mode":
+			if err := checkRabbitMode(value); err != nil {
+				return err
+			}
+			rabbit.Mode = value
+		case "notification_exchange":
+			rabbit.NotificationExchange = value
+		case "notification_topic":
+			rabbit.NotificationTopic = value
+		case "event_type":
+			rabbit.EventType = value
+		case "publisher_id":
+			rabbit.PublisherID = value
+		case "priority":
+			if err := checkPriority(value); err != nil {
+				return err
+			}
+			rabbit.Priority = value
+		default:
+			return fmt.Errorf("unknown rabbit key %v", k)
+		}
+	}
+	return nil
 }
 
 type config struct {
 	Credentials struct {
 		Rabbit    rabbitCreds
-		Openstack struct {
-			AuthOptions gophercloud.AuthOptions
-		}
+		Openstack openstackCreds
 	}
-	Graphite struct {
+	Publishers []publisherConfig
+	RGW        rgwConfig
+	Ring       ringConfig
+	Graphite   struct {
 		Port     int
 		Hostname string
 		Prefix   string
 	}
-	Region   string
-	Timeout  time.Duration
-	Workers  int
-	LogLevel string
+	Regions []regionConfig
+	// RegionDefaults are the settings of discovered regions absent from Regions.
+	RegionDefaults    regionConfig
+	RegionDiscovery   bool
+	EndpointInterface string
+	EndpointSource    string
+	Timeout           time.Duration
+	Workers           int
+	LogLevel          string
+	Meters            []meter
+	Retry             retryPolicy
+	// Tokens are renewed when they expire in less than this.
+	TokenRefreshMargin time.Duration
+	Containers         containerSampling
+	Audit              auditConfig
+	Recon              bool
+	Consistency        consistencyConfig
+	Projects           projectFilter
+	ResellerPrefixes   []string
+	MappedAccounts     []mappedAccount
 }
 
 func readConfig(configPath string, logLevel string) (config, error) {
@@ -83,8 +372,6 @@ func readConfig(configPath string, logLevel string) (config, error) {
 
 	conf.Timeout = viper.GetDuration("timeout")
 
-	conf.Region = viper.GetString("region")
-
 	opts := gophercloud.AuthOptions{
 		IdentityEndpoint: viper.GetString("credentials.openstack.keystone_uri"),
 		Username:         viper.GetString("credentials.openstack.swift_conso_user"),
@@ -92,22 +379,254 @@ func readConfig(configPath string, logLevel string) (config, error) {
 		TenantName:       viper.GetString("credentials.openstack.swift_conso_tenant"),
 		DomainName:       viper.GetString("credentials.openstack.swift_conso_domain"),
 	}
-	conf.Credentials.Openstack.AuthOptions = opts
+	switch viper.GetString("credentials.openstack.auth_type") {
+	case authV1:
+		// The v1 exchange sends the user and key as X-Auth-User and X-Auth-Key.
+		opts = gophercloud.AuthOptions{
+			IdentityEndpoint: viper.GetString("credentials.openstack.auth_url"),
+			Username:         opts.Username,
+			Password:         viper.GetString("credentials.openstack.auth_key"),
+		}
+	case authV3Token:
+		// A token can only be rescoped by project ID, and cannot be combined with a user domain.
+		opts = gophercloud.AuthOptions{
+			IdentityEndpoint: opts.IdentityEndpoint,
+			TokenID:          viper.GetString("credentials.openstack.token"),
+			TenantID:         viper.GetString("credentials.openstack.swift_conso_tenant_id"),
+		}
+	}
+	conf.Credentials.Openstack = openstackCreds{
+		AuthType:                    viper.GetString("credentials.openstack.auth_type"),
+		AuthOptions:                 opts,
+		ApplicationCredentialID:     viper.GetString("credentials.openstack.application_credential_id"),
+		ApplicationCredentialSecret: viper.GetString("credentials.openstack.application_credential_secret"),
+	}
 
+	viper.SetDefault("credentials.rabbit.envelope", envelopeNone)
+	viper.SetDefault("credentials.rabbit.mode", rabbitModeRPC)
+	viper.SetDefault("credentials.rabbit.notification_exchange", "ceilometer")
+	viper.SetDefault("credentials.rabbit.notification_topic", "notifications")
+	viper.SetDefault("credentials.rabbit.event_type", "telemetry.polling")
+	viper.SetDefault("credentials.rabbit.publisher_id", "swift-consometer")
+	viper.SetDefault("credentials.rabbit.priority", "sample")
 	rabbit := rabbitCreds{
-		Host:       viper.GetString("credentials.rabbit.host"),
-		User:       viper.GetString("credentials.rabbit.user"),
-		Password:   viper.GetString("credentials.rabbit.password"),
-		Vhost:      viper.GetString("credentials.rabbit.vhost"),
-		Exchange:   viper.GetString("credentials.rabbit.exchange"),
-		RoutingKey: viper.GetString("credentials.rabbit.routing_key"),
-		Queue:      viper.GetString("credentials.rabbit.queue"),
-	}
-	rabbit.URI = strings.Join([]string{"amqp://", rabbit.User, ":", rabbit.Password, "@", rabbit.Host, "/", rabbit.Vhost}, "")
+		Host:           viper.GetString("credentials.rabbit.host"),
+		User:           viper.GetString("credentials.rabbit.user"),
+		Password:       viper.GetString("credentials.rabbit.password"),
+		Vhost:          viper.GetString("credentials.rabbit.vhost"),
+		Exchange:       viper.GetString("credentials.rabbit.exchange"),
+		RoutingKey:     viper.GetString("credentials.rabbit.routing_key"),
+		Queue:          viper.GetString("credentials.rabbit.queue"),
+		Envelope:       viper.GetString("credentials.rabbit.envelope"),
+		MeteringSecret: viper.GetString("credentials.rabbit.metering_secret"),
+
+		Mode:                 viper.GetString("credentials.rabbit.mode"),
+		NotificationExchange: viper.GetString("credentials.rabbit.notification_exchange"),
+		NotificationTopic:    viper.GetString("credentials.rabbit.notification_topic"),
+		EventType:            viper.GetString("credentials.rabbit.event_type"),
+		PublisherID:          viper.GetString("credentials.rabbit.publisher_id"),
+		Priority:             viper.GetString("credentials.rabbit.priority"),
+	}
+	if err := checkEnvelope(rabbit.Envelope); err != nil {
+		return conf, errors.Wrap(err, "Bad credentials.rabbit.envelope")
+	}
+	if err := checkRabbitMode(rabbit.Mode); err != nil {
+		return conf, errors.Wrap(err, "Bad credentials.rabbit.mode")
+	}
+	if err := checkPriority(rabbit.Priority); err != nil {
+		return conf, errors.Wrap(err, "Bad credentials.rabbit.priority")
+	}
+	rabbit.setURI()
 	conf.Credentials.Rabbit = rabbit
 
+	viper.SetDefault("publisher.type", publisherRabbit)
+	viper.SetDefault("publisher.file.max_size", 100<<20)
+	viper.SetDefault("publisher.file.max_files", 5)
+	viper.SetDefault("publisher.http.timeout", "30s")
+	var publisher publisherConfig
+	publisher.Type = viper.GetString("publisher.type")
+	publisher.Name = publisher.Type
+	publisher.Timeout = viper.GetDuration("publisher.timeout")
+	publisher.File.Path = viper.GetString("publisher.file.path")
+	publisher.File.MaxSize = viper.GetInt64("publisher.file.max_size")
+	publisher.File.MaxFiles = viper.GetInt("publisher.file.max_files")
+	publisher.HTTP.URL = viper.GetString("publisher.http.url")
+	publisher.HTTP.Timeout = viper.GetDuration("publisher.http.timeout")
+	if !viper.IsSet("publishers") {
+		if err := publisher.check(); err != nil {
+			return conf, errors.Wrap(err, "Bad publisher")
+		}
+	}
+	publishers, err := readPublishers(publisher)
+	if err != nil {
+		return conf, errors.Wrap(err, "Bad publishers")
+	}
+	conf.Publishers = publishers
+	for _, p := range publishers {
+		if p.Type != publisherRabbit {
+			continue
+		}
+		for _, key := range []string{"host", "user", "password", "exchange", "routing_key", "vhost", "queue"} {
+			if !viper.IsSet("credentials.rabbit." + key) {
+				return conf, fmt.Errorf("Incomplete configuration. Missing key credentials.rabbit.%s", key)
+			}
+		}
+	}
+
 	conf.Workers = viper.GetInt("workers")
 
+	viper.SetDefault("min_workers", conf.Workers)
+	viper.SetDefault("max_workers", conf.Workers)
+	viper.SetDefault("backend", backendSwift)
+	conf.RegionDefaults = regionConfig{
+		Name:           viper.GetString("region"),
+		Timeout:        conf.Timeout,
+		Workers:        conf.Workers,
+		ObjectStoreURL: viper.GetString("object_store_url"),
+		MinWorkers:     viper.GetInt("min_workers"),
+		MaxWorkers:     viper.GetInt("max_workers"),
+		Rabbit:         conf.Credentials.Rabbit,
+		Backend:        viper.GetString("backend"),
+		RGWEndpoint:    viper.GetString("rgw_endpoint"),
+		AccountRing:    viper.GetString("account_ring"),
+		ReconNodes:     viper.GetStringSlice("recon.nodes"),
+		ReconRing:      viper.GetString("recon.ring"),
+	}
+	if err := conf.RegionDefaults.checkWorkers(); err != nil {
+		return conf, errors.Wrap(err, "Bad workers")
+	}
+	if err := conf.RegionDefaults.checkBackend(); err != nil {
+		return conf, errors.Wrap(err, "Bad backend")
+	}
+	regions, err := readRegions(conf.RegionDefaults)
+	if err != nil {
+		return conf, errors.Wrap(err, "Bad regions")
+	}
+	conf.Regions = regions
+	for _, region := range append(regions, conf.RegionDefaults) {
+		if region.Backend == backendRGW && (!viper.IsSet("credentials.rgw.access_key") || !viper.IsSet("credentials.rgw.secret_key")) {
+			return conf, fmt.Errorf("Incomplete configuration. Backend %s needs credentials.rgw.access_key and credentials.rgw.secret_key", backendRGW)
+		}
+	}
+	viper.SetDefault("ring.answer", ringAnswerMajority)
+	conf.Ring = ringConfig{
+		HashPathPrefix: viper.GetString("ring.hash_path_prefix"),
+		HashPathSuffix: viper.GetString("ring.hash_path_suffix"),
+		Answer:         viper.GetString("ring.answer"),
+	}
+	switch conf.Ring.Answer {
+	case ringAnswerMajority, ringAnswerNewest:
+	default:
+		return conf, fmt.Errorf("Unknown ring.answer %s", conf.Ring.Answer)
+	}
+	// Like swift, refuse to hash without the secret of the cluster: every account would
+	// be looked up in the wrong partition.
+	for _, region := range append(regions, conf.RegionDefaults) {
+		if region.Backend == backendRing && conf.Ring.HashPathPrefix == "" && conf.Ring.HashPathSuffix == "" {
+			return conf, fmt.Errorf("Incomplete configuration. Backend %s needs ring.hash_path_prefix or ring.hash_path_suffix", backendRing)
+		}
+	}
+	viper.SetDefault("rgw.admin_path", "admin")
+	conf.RGW = rgwConfig{
+		AccessKey:       viper.GetString("credentials.rgw.access_key"),
+		SecretKey:       viper.GetString("credentials.rgw.secret_key"),
+		AdminPath:       viper.GetString("rgw.admin_path"),
+		ImplicitTenants: viper.GetBool("rgw.implicit_tenants"),
+	}
+	conf.RegionDiscovery = viper.GetBool("region_discovery")
+
+	viper.SetDefault("endpoint_interface", "admin")
+	conf.EndpointInterface = viper.GetString("endpoint_interface")
+	switch conf.EndpointInterface {
+	case "admin", "internal", "public":
+	default:
+		return conf, fmt.Errorf("Unknown endpoint_interface %s", conf.EndpointInterface)
+	}
+	conf.EndpointSource = viper.GetString("endpoint_source")
+
+	meters, err := parseMeters(viper.GetStringSlice("meters"))
+	if err != nil {
+		return conf, errors.Wrap(err, "Bad meters")
+	}
+	conf.Meters = meters
+
+	viper.SetDefault("token_refresh_margin", "5m")
+	conf.TokenRefreshMargin = viper.GetDuration("token_refresh_margin")
+
+	viper.SetDefault("retry.attempts", 2)
+	viper.SetDefault("retry.base_delay", "200ms")
+	viper.SetDefault("retry.max_delay", "5s")
+	viper.SetDefault("retry.request_timeout", "30s")
+	conf.Retry = retryPolicy{
+		Attempts:       viper.GetInt("retry.attempts"),
+		BaseDelay:      viper.GetDuration("retry.base_delay"),
+		MaxDelay:       viper.GetDuration("retry.max_delay"),
+		RequestTimeout: viper.GetDuration("retry.request_timeout"),
+	}
+	if conf.Retry.Attempts < 1 {
+		return conf, fmt.Errorf("retry.attempts must be at least 1")
+	}
+
+	projects, err := readProjectFilter()
+	if err != nil {
+		return conf, errors.Wrap(err, "Bad projects filter")
+	}
+	conf.Projects = projects
+
+	viper.SetDefault("reseller_prefixes", []string{"AUTH_"})
+	conf.ResellerPrefixes = viper.GetStringSlice("reseller_prefixes")
+	if len(conf.ResellerPrefixes) == 0 {
+		return conf, fmt.Errorf("reseller_prefixes cannot be empty")
+	}
+	if path := viper.GetString("accounts_file"); path != "" {
+		mapped, err := readAccountsFile(path)
+		if err != nil {
+			return conf, errors.Wrap(err, "Could not read accounts_file")
+		}
+		conf.MappedAccounts = mapped
+	}
+	for i, line := range viper.GetStringSlice("accounts") {
+		account, err := parseAccountLine(line)
+		if err != nil {
+			return conf, errors.Wrapf(err, "Bad accounts entry %d", i+1)
+		}
+		conf.MappedAccounts = append(conf.MappedAccounts, account)
+	}
+
+	conf.Containers.enabled = viper.GetBool("containers.enabled")
+	conf.Containers.projects = make(map[string]bool)
+	for _, id := range viper.GetStringSlice("containers.projects") {
+		conf.Containers.projects[id] = true
+	}
+
+	viper.SetDefault("consistency.x_newest", newestNever)
+	viper.SetDefault("consistency.drop_threshold", 0.1)
+	conf.Consistency = consistencyConfig{
+		newest:        viper.GetString("consistency.x_newest"),
+		projects:      make(map[string]bool),
+		dropThreshold: viper.GetFloat64("consistency.drop_threshold"),
+	}
+	for _, id := range viper.GetStringSlice("consistency.projects") {
+		conf.Consistency.projects[id] = true
+	}
+	switch conf.Consistency.newest {
+	case newestNever, newestAlways, newestProjects, newestFallback:
+	default:
+		return conf, fmt.Errorf("Unknown consistency.x_newest %s", conf.Consistency.newest)
+	}
+
+	conf.Recon = viper.GetBool("recon.enabled")
+
+	viper.SetDefault("audit.sample_ratio", 0.01)
+	conf.Audit = auditConfig{
+		enabled:          viper.GetBool("audit.enabled"),
+		ratio:            viper.GetFloat64("audit.sample_ratio"),
+		correctThreshold: viper.GetFloat64("audit.correct_threshold"),
+	}
+	if conf.Audit.ratio < 0 || conf.Audit.ratio > 1 {
+		return conf, fmt.Errorf("audit.sample_ratio must be between 0 and 1")
+	}
+
 	conf.Graphite.Hostname = "graphite-relay.localdomain"
 	conf.Graphite.Port = 2003
 	conf.Graphite.Prefix = "swift-consometer"
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// When account HEADs ask the proxy for the newest replica with X-Newest.
+const (
+	newestNever    = "never"
+	newestAlways   = "always"
+	newestProjects = "projects" // only for consistencyConfig.projects
+	newestFallback = "fallback" // again with X-Newest when the usage drops since the previous run
+)
+
+// Consistency modes of the account HEADs, counted in RegionReport.
+const (
+	consistencyDefault  = "default"  // first replica to answer
+	consistencyNewest   = "newest"   // X-Newest from the start
+	consistencyFallback = "fallback" // X-Newest after an unexpected drop
+)
+
+var consistencyModes = []string{consistencyDefault, consistencyNewest, consistencyFallback}
+
+type consistencyConfig struct {
+	newest   string
+	projects map[string]bool
+	// Relative drop of the bytes used since the previous run triggering a fallback HEAD.
+	dropThreshold float64
+}
+
+// mode returns the consistency of the first HEAD of the account.
+func (c consistencyConfig) mode(project Project) string {
+	switch {
+	case c.newest == newestAlways, c.newest == newestProjects && c.projects[project.ID]:
+		return consistencyNewest
+	}
+	return consistencyDefault
+}
+
+// usageHistory remembers the bytes used by each account on the previous run.
+type usageHistory struct {
+	sync.Mutex
+	bytes map[string]int64
+}
+
+func newUsageHistory() *usageHistory {
+	return &usageHistory{bytes: make(map[string]int64)}
+}
+
+// dropped records the bytes used in header and tells whether they dropped by more than
+// threshold since the previous run.
+func (h *usageHistory) dropped(key string, header http.Header, threshold float64) bool {
+	bytes, err := strconv.ParseInt(header.Get("X-Account-Bytes-Used"), 10, 64)
+	if err != nil {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	previous, ok := h.bytes[key]
+	h.bytes[key] = bytes
+	return ok && previous > 0 && float64(previous-bytes)/float64(previous) > threshold
+}
+
+// record overwrites the bytes used by the account, once the fallback HEAD answered.
+func (h *usageHistory) record(key string, header http.Header) {
+	bytes, err := strconv.ParseInt(header.Get("X-Account-Bytes-Used"), 10, 64)
+	if err != nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.bytes[key] = bytes
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var containerMeters = []struct {
+	Name string
+	Unit string
+}{
+	{Name: "storage.containers.objects.size", Unit: "B"},
+	{Name: "storage.containers.objects", Unit: "object"},
+}
+
+// containerSampling selects the projects for which per container samples are emitted.
+type containerSampling struct {
+	enabled  bool
+	projects map[string]bool // allowlist of project IDs, empty means every project
+}
+
+func (c containerSampling) wants(project Project) bool {
+	if !c.enabled {
+		return false
+	}
+	return len(c.projects) == 0 || c.projects[project.ID]
+}
+
+type containerInfo struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// listContainers pages through the JSON listing of an account using marker, until an
+// empty page. The page size is left to the account_listing_limit of the proxy.
+func listContainers(ctx context.Context, accountURL string, sess *session) ([]containerInfo, error) {
+	var containers []containerInfo
+	marker := ""
+	for {
+		pageURL := fmt.Sprintf("%s?format=json&marker=%s", accountURL, url.QueryEscape(marker))
+		req, err := newSwiftRequest(ctx, "GET", pageURL)
+		if err != nil {
+			return containers, err
+		}
+		resp, err := sess.do(req, &sess.httpClient)
+		if err != nil {
+			return containers, errors.Wrap(err, "Could not list containers")
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return containers, errors.Wrap(err, "Could not read container listing")
+		}
+		if resp.StatusCode != 200 && resp.StatusCode != 204 {
+			return containers, fmt.Errorf("Bad response status when listing containers: %s", resp.Status)
+		}
+		if resp.StatusCode == 204 || len(body) == 0 {
+			return containers, nil
+		}
+		var page []containerInfo
+		if err := json.Unmarshal(body, &page); err != nil {
+			return containers, errors.Wrap(err, "Failed unmarshalling container listing")
+		}
+		if len(page) == 0 {
+			return containers, nil
+		}
+		containers = append(containers, page...)
+		marker = page[len(page)-1].Name
+	}
+}
+
+// containerSamples returns the per container samples of a project.
+func containerSamples(containers []containerInfo, project Project, region string) []AccountInfo {
+	var ais []AccountInfo
+	for _, c := range containers {
+		for _, cm := range containerMeters {
+			volume := c.Bytes
+			if cm.Unit == "object" {
+				volume = c.Count
+			}
+			ai := newSample(meter{Name: cm.Name, Unit: cm.Unit}, project, region, strconv.FormatInt(volume, 10))
+			ai.ResourceID = project.ID + "/" + c.Name
+			ais = append(ais, ai)
+		}
+	}
+	return ais
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+// regionTracker remembers the regions discovered on the previous run
+// so that regions appearing or disappearing can be reported.
+type regionTracker struct {
+	sync.Mutex
+	known map[string]bool
+
+	discovered int
+	added      []string
+	removed    []string
+}
+
+// update records the regions found by the current run and returns what changed since the previous one.
+// The first run only records the regions.
+func (t *regionTracker) update(regions []string) (added, removed []string) {
+	t.Lock()
+	defer t.Unlock()
+
+	current := make(map[string]bool)
+	for _, r := range regions {
+		current[r] = true
+		if t.known != nil && !t.known[r] {
+			added = append(added, r)
+		}
+	}
+	for r := range t.known {
+		if !current[r] {
+			removed = append(removed, r)
+		}
+	}
+	t.known = current
+	t.discovered, t.added, t.removed = len(regions), added, removed
+	return added, removed
+}
+
+func (t *regionTracker) Publish(gf *graphite.Graphite) {
+	t.Lock()
+	defer t.Unlock()
+	gf.SimpleSend("regions.discovered", fmt.Sprintf("%d", t.discovered))
+	gf.SimpleSend("regions.added", fmt.Sprintf("%d", len(t.added)))
+	gf.SimpleSend("regions.removed", fmt.Sprintf("%d", len(t.removed)))
+}
+
+// discoverRegions returns the settings of every region found in the endpoint catalog.
+// Regions listed in conf.Regions keep their own settings, others use conf.RegionDefaults.
+func discoverRegions(conf config, names []string) []regionConfig {
+	var regions []regionConfig
+	for _, name := range names {
+		region := conf.RegionDefaults
+		region.Name = name
+		for _, r := range conf.Regions {
+			if r.Name == name {
+				region = r
+				break
+			}
+		}
+		regions = append(regions, region)
+	}
+	return regions
+}
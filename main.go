@@ -16,11 +16,7 @@ import (
 
 	"net/http"
 
-	"github.com/gophercloud/gophercloud"
-	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/marpaia/graphite-golang"
-	"github.com/pborman/uuid"
-	"github.com/pkg/errors"
 )
 
 // This is the share of time dedicated to each stage of the pipeline.
@@ -37,74 +33,201 @@ type RegionPollConfig struct {
 	objectStoreUrl string
 	region         string
 	workers        int
-	rabbit         rabbitCreds
+	minWorkers     int
+	maxWorkers     int
+	retry          retryPolicy
+	publishers     []regionPublisher
+	meters         []meter
+	containers     containerSampling
+	// Set when the region is served by radosgw instead of swift.
+	rgw *rgwClient
+	// Set when the account servers are polled directly instead of the proxies.
+	ring        *accountRing
+	audit       auditConfig
+	consistency consistencyConfig
+	history     *usageHistory
 }
 
 var AppVersion = "No version provided"
 
 type RegionReport struct {
 	// TopAccounts [5]AccountInfo
-	TotalConso         int64
+	Totals             map[string]int64            // summed volume per counter name
+	PolicyTotals       map[string]map[string]int64 // summed volume per storage policy and counter name
 	RunDuration        time.Duration
 	PolledSuccessfully int
 	Polled             int
 	Projects           int
-	Published          int
+	Accounts           int
+	Samples            int            // samples built from the accounts polled successfully
+	Published          map[string]int // samples confirmed by each publisher
+	Unroutable         map[string]int // samples returned by the broker of each publisher
+	Containers         int
+	QuotaAccounts      int // accounts with a quota set
+	OverQuota80        int
+	OverQuota90        int
+	OverQuota100       int
+	Concurrency        int // number of concurrent workers when swift polling ended
+	PeakConcurrency    int
+	Failures           map[string]int // number of accounts per class of outcome
+	Skipped            int            // projects not polled before the swift stage deadline
+	Audit              auditReport
+	Consistency        map[string]int // number of account HEADs per consistency mode
+	Recon              *reconReport   // nil unless recon is enabled
 	Region             string
 }
 
 func (r RegionReport) Publish(gf *graphite.Graphite) {
-	gf.SimpleSend(fmt.Sprintf("%v.published", r.Region), fmt.Sprintf("%d", r.Published))
+	for name, published := range r.Published {
+		gf.SimpleSend(fmt.Sprintf("%v.publishedsamples.%v", r.Region, name), fmt.Sprintf("%d", published))
+		gf.SimpleSend(fmt.Sprintf("%v.unroutable.%v", r.Region, name), fmt.Sprintf("%d", r.Unroutable[name]))
+	}
 	gf.SimpleSend(fmt.Sprintf("%v.polledsuccessfully", r.Region), fmt.Sprintf("%d", r.PolledSuccessfully))
+	gf.SimpleSend(fmt.Sprintf("%v.samples", r.Region), fmt.Sprintf("%d", r.Samples))
 	gf.SimpleSend(fmt.Sprintf("%v.polled", r.Region), fmt.Sprintf("%d", r.Polled))
 	gf.SimpleSend(fmt.Sprintf("%v.projects", r.Region), fmt.Sprintf("%d", r.Projects))
+	gf.SimpleSend(fmt.Sprintf("%v.accounts", r.Region), fmt.Sprintf("%d", r.Accounts))
+	gf.SimpleSend(fmt.Sprintf("%v.skipped", r.Region), fmt.Sprintf("%d", r.Skipped))
+	gf.SimpleSend(fmt.Sprintf("%v.containers", r.Region), fmt.Sprintf("%d", r.Containers))
+	gf.SimpleSend(fmt.Sprintf("%v.quota.accounts", r.Region), fmt.Sprintf("%d", r.QuotaAccounts))
+	gf.SimpleSend(fmt.Sprintf("%v.quota.over80", r.Region), fmt.Sprintf("%d", r.OverQuota80))
+	gf.SimpleSend(fmt.Sprintf("%v.quota.over90", r.Region), fmt.Sprintf("%d", r.OverQuota90))
+	gf.SimpleSend(fmt.Sprintf("%v.quota.over100", r.Region), fmt.Sprintf("%d", r.OverQuota100))
 	gf.SimpleSend(fmt.Sprintf("%v.runduration", r.Region), fmt.Sprintf("%d", int(r.RunDuration.Seconds())))
+	gf.SimpleSend(fmt.Sprintf("%v.concurrency", r.Region), fmt.Sprintf("%d", r.Concurrency))
+	gf.SimpleSend(fmt.Sprintf("%v.peakconcurrency", r.Region), fmt.Sprintf("%d", r.PeakConcurrency))
+	for _, class := range failureClasses {
+		gf.SimpleSend(fmt.Sprintf("%v.failures.%v", r.Region, class), fmt.Sprintf("%d", r.Failures[class]))
+	}
+	for _, mode := range consistencyModes {
+		gf.SimpleSend(fmt.Sprintf("%v.consistency.%v", r.Region, mode), fmt.Sprintf("%d", r.Consistency[mode]))
+	}
+	if r.Audit.Audited > 0 {
+		r.Audit.Publish(gf, r.Region)
+	}
 	// We publish total consumption only if we actually managed to poll stuff.
 	// TODO: this sucks actually ...
-	if float32(r.PolledSuccessfully)/float32(r.Projects) > 0.99 {
-		gf.SimpleSend(fmt.Sprintf("%v.totalconso", r.Region), fmt.Sprintf("%d", r.TotalConso))
+	complete := float32(r.PolledSuccessfully)/float32(r.Accounts) > 0.99
+	if r.Recon != nil {
+		var billed int64
+		if complete {
+			billed = r.Totals[availableMeters[0].Name]
+		}
+		r.Recon.Publish(gf, r.Region, billed)
+	}
+	if complete {
+		for _, m := range availableMeters {
+			if total, ok := r.Totals[m.Name]; ok {
+				gf.SimpleSend(fmt.Sprintf("%v.%v", r.Region, m.Graphite), fmt.Sprintf("%d", total))
+			}
+			for policy, totals := range r.PolicyTotals {
+				if total, ok := totals[m.Name]; ok {
+					gf.SimpleSend(fmt.Sprintf("%v.policies.%v.%v", r.Region, strings.Replace(policy, ".", "_", -1), m.Graphite), fmt.Sprintf("%d", total))
+				}
+			}
+		}
+	}
+}
+
+func (r *RegionReport) countQuota(ai AccountInfo) {
+	utilization, err := strconv.ParseFloat(ai.CounterVolume, 64)
+	if err != nil {
+		return
+	}
+	r.QuotaAccounts++
+	if utilization >= 0.8 {
+		r.OverQuota80++
+	}
+	if utilization >= 0.9 {
+		r.OverQuota90++
+	}
+	if utilization >= 1 {
+		r.OverQuota100++
 	}
 }
 
 type AccountResult struct {
-	ai  AccountInfo
-	err error
+	ais     []AccountInfo
+	class   string // outcome of the account HEAD, see failureClasses
+	skipped bool   // the deadline expired before the project could be polled
+	audit   *auditResult
+	// Consistency mode of the account HEAD, see consistencyModes.
+	consistency string
+	err         error
 }
 
 type AccountInfo struct {
-	CounterName      string  `json:"counter_name"`       //"storage.objects.size",
-	ResourceID       string  `json:"resource_id"`        //"d5bbc7c06c9e479dbb91912c045cdeab",
-	MessageID        string  `json:"message_id"`         //"1",
-	Timestamp        string  `json:"timestamp"`          // "2013-05-13T14:03:01Z",
-	CounterVolume    string  `json:"counter_volume"`     // "0",
-	UserID           *string `json:"user_id"`            // null,
-	Source           string  `json:"source"`             // "openstack",
-	CounterUnit      string  `json:"counter_unit"`       // "B",
-	ProjectID        string  `json:"project_id"`         // "d5bbc7c06c9e479dbb91912c045cdeab",
-	CounterType      string  `json:"counter_type"`       // "gauge",
-	ResourceMetadata *string `json:"ressource_metadata"` // null
-	Region           string  `json:"region"`             // "int5"
+	CounterName      string            `json:"counter_name"`       //"storage.objects.size",
+	ResourceID       string            `json:"resource_id"`        //"d5bbc7c06c9e479dbb91912c045cdeab",
+	MessageID        string            `json:"message_id"`         //"1",
+	Timestamp        string            `json:"timestamp"`          // "2013-05-13T14:03:01Z",
+	CounterVolume    string            `json:"counter_volume"`     // "0",
+	UserID           *string           `json:"user_id"`            // null,
+	Source           string            `json:"source"`             // "openstack",
+	CounterUnit      string            `json:"counter_unit"`       // "B",
+	ProjectID        string            `json:"project_id"`         // "d5bbc7c06c9e479dbb91912c045cdeab",
+	CounterType      string            `json:"counter_type"`       // "gauge",
+	ResourceMetadata map[string]string `json:"ressource_metadata"` // null or {"storage_policy": "gold"}
+	Region           string            `json:"region"`             // "int5"
 }
 
 func ReduceAccounts(cfg *RegionPollConfig, in <-chan AccountResult) (RegionReport, error) {
 	chunksize := 200
-	rr := RegionReport{Region: cfg.region}
+	rr := RegionReport{Region: cfg.region, Totals: make(map[string]int64), PolicyTotals: make(map[string]map[string]int64),
+		Failures: make(map[string]int), Consistency: make(map[string]int), Published: make(map[string]int),
+		Unroutable: make(map[string]int)}
 
 	var chunkedAccounts [][]AccountInfo
 	var allAccounts []AccountInfo
 	for ar := range in {
+		if ar.skipped {
+			rr.Skipped++
+			continue
+		}
 		rr.Polled++
+		if ar.audit != nil {
+			rr.Audit.add(*ar.audit)
+		}
+		if ar.consistency != "" {
+			rr.Consistency[ar.consistency]++
+		}
+		if ar.class != "" {
+			rr.Failures[ar.class]++
+		}
 		if ar.err == nil {
 			rr.PolledSuccessfully++
-			conso, err := strconv.ParseInt(ar.ai.CounterVolume, 10, 64)
-			if err == nil {
-				rr.TotalConso += conso
+			for _, ai := range ar.ais {
+				if ai.CounterName == containerMeters[0].Name {
+					rr.Containers++
+				}
+				if ai.CounterName == quotaMeter.Name {
+					rr.countQuota(ai)
+					continue
+				}
+				volume, err := strconv.ParseInt(ai.CounterVolume, 10, 64)
+				if err != nil {
+					continue
+				}
+				if policy, ok := ai.ResourceMetadata["storage_policy"]; ok {
+					if rr.PolicyTotals[policy] == nil {
+						rr.PolicyTotals[policy] = make(map[string]int64)
+					}
+					rr.PolicyTotals[policy][meterName(ai.CounterName)] += volume
+					continue
+				}
+				rr.Totals[ai.CounterName] += volume
 			}
-			allAccounts = append(allAccounts, ar.ai)
+			allAccounts = append(allAccounts, ar.ais...)
 		}
 	}
 
 	log.Infof("Polled %d accounts successfully our of %d", rr.PolledSuccessfully, rr.Polled)
+	rr.Samples = len(allAccounts)
+	// Accounts missing from every replica are billed zero, unless the whole region is:
+	// the ring or its hash path settings are then most likely wrong.
+	if cfg.ring != nil && rr.Polled > 0 && rr.Failures[failureNotFound] == rr.Polled {
+		return rr, fmt.Errorf("no account found on the replicas of the ring, not publishing zero usage")
+	}
 	fits := len(allAccounts) / chunksize
 	for i := 0; i < fits; i++ {
 		chunkedAccounts = append(chunkedAccounts, allAccounts[i*chunksize:(i+1)*chunksize])
@@ -112,20 +235,57 @@ func ReduceAccounts(cfg *RegionPollConfig, in <-chan AccountResult) (RegionRepor
 	chunkedAccounts = append(chunkedAccounts, allAccounts[fits*chunksize:])
 
 	if len(chunkedAccounts) == 0 {
-		return rr, fmt.Errorf("nothing to publish to rabbitMQ")
+		return rr, fmt.Errorf("nothing to publish")
 	}
 
-	publishChan, confirmChan, err := setupRabbit(cfg.rabbit)
+	// Every publisher gets every chunk, each within its own deadline.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, p := range cfg.publishers {
+		wg.Add(1)
+		go func(p regionPublisher) {
+			defer wg.Done()
+			timeout := p.timeout
+			if timeout == 0 {
+				timeout = cfg.timeout * tsRabbitMQ / tsSum
+			}
+			published, unroutable, err := publish(p, chunkedAccounts, timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			rr.Published[p.name] = published
+			if unroutable > 0 {
+				rr.Unroutable[p.name] = unroutable
+				log.Errorf("%d samples could not be routed by %s", unroutable, p.name)
+			}
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", p.name, err))
+				return
+			}
+			log.Infof("published %d samples to %s out of %d", published, p.name, rr.Samples)
+		}(p)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return rr, fmt.Errorf("cannot setup publishers: %s", strings.Join(failed, "; "))
+	}
+	return rr, nil
+}
+
+// publish sends the chunks to a publisher and returns the number of samples it confirmed
+// before timeout, and of those it could not route.
+func publish(p regionPublisher, chunks [][]AccountInfo, timeout time.Duration) (published, unroutable int, err error) {
+	// Retries of the last chunks go on after they are all handed to the publisher.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	publishChan, confirmChan, err := p.Setup(ctx)
 	if err != nil {
-		return rr, errors.Wrap(err, "cannot setupRabbit")
+		return 0, 0, err
 	}
-	// publishChan, confirmChan, _ := fakeSetupRabbit()
 
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout*tsRabbitMQ/tsSum)
 	go func() {
 		defer close(publishChan)
-		defer cancel()
-		for _, a := range chunkedAccounts {
+		for _, a := range chunks {
 			select {
 			case <-ctx.Done():
 				return
@@ -134,82 +294,183 @@ func ReduceAccounts(cfg *RegionPollConfig, in <-chan AccountResult) (RegionRepor
 		}
 	}()
 
-	for published := range confirmChan {
-		rr.Published += published
+	for n := range confirmChan {
+		published += n
 	}
-	log.Infof("published %d accounts out of %d polled successfully", rr.Published, rr.Polled)
-	return rr, nil
+	if c, ok := p.Publisher.(unroutableCounter); ok {
+		unroutable = c.Unroutable()
+	}
+	return published, unroutable, nil
 }
 
-func pollProject(objectStoreURL, region string, project Project, provider *gophercloud.ProviderClient) (AccountInfo, error) {
-	accountURL := strings.Join([]string{objectStoreURL, "/v1/AUTH_", project.ID}, "")
-	retry := true
-	for {
-		resp, err := provider.Request("HEAD", accountURL, &gophercloud.RequestOpts{OkCodes: []int{204, 200}})
-		if err != nil {
-			if retry {
-				retry = false
-				log.Debug(err, " Retrying")
-				<-time.After(200 * time.Millisecond)
-				continue
-			} else {
-				log.Error(err)
-				return AccountInfo{}, err
-			}
+// accountURL returns the URL of account on the proxies, or on the account server
+// holding its first replica when polling the account servers directly.
+func (cfg *RegionPollConfig) accountURL(account Account) string {
+	if cfg.ring != nil {
+		if urls := cfg.ring.accountURLs(account.String()); len(urls) > 0 {
+			return urls[0]
 		}
-		defer resp.Body.Close()
-		log.Debug("Fetched account: ", accountURL)
-		ai := AccountInfo{
-			CounterName:      "storage.objects.size",
-			ResourceID:       project.ID,
-			MessageID:        uuid.New(),
-			Timestamp:        time.Now().Format(time.RFC3339),
-			CounterVolume:    resp.Header.Get("x-account-bytes-used"),
-			UserID:           nil,
-			Source:           "openstack",
-			CounterUnit:      "B",
-			ProjectID:        project.ID,
-			CounterType:      "gauge",
-			ResourceMetadata: nil,
-			Region:           region,
+	}
+	return accountURL(cfg.objectStoreUrl, account)
+}
+
+func accountURL(objectStoreURL string, account Account) string {
+	return strings.Join([]string{objectStoreURL, "/v1/", account.String()}, "")
+}
+
+// pollAccount returns the samples of an account, the class of failure if any, and the
+// consistency mode of the HEAD when sent through the proxies.
+// A primary account that was never created is not a failure: it is reported with zero usage.
+func pollAccount(ctx context.Context, cfg *RegionPollConfig, account Account, sess *session,
+	ctl *concurrencyController) (ais []AccountInfo, class, mode string, err error) {
+	if cfg.rgw != nil {
+		ais, class, err = pollRGWAccount(ctx, cfg, account, ctl)
+		return ais, class, "", err
+	}
+	project := account.Project
+	accountURL := cfg.accountURL(account)
+	var header http.Header
+	if cfg.ring != nil {
+		header, class, err = headAccountReplicas(ctx, cfg.ring, account.String(), cfg.retry, ctl)
+	} else {
+		header, class, mode, err = headAccountConsistent(ctx, cfg, account, sess, ctl)
+	}
+	switch {
+	case class == failureNotFound:
+		log.Debug("Account not found: ", accountURL)
+		if account.Primary {
+			for _, m := range cfg.meters {
+				ais = append(ais, newSample(m, project, cfg.region, "0"))
+			}
 		}
-		return ai, nil
+		tagAccount(ais, account)
+		return ais, class, mode, nil
+	case err != nil && ctx.Err() != nil:
+		return nil, class, mode, err
+	case err != nil:
+		log.Error(err)
+		return nil, class, mode, err
+	}
+	log.Debug("Fetched account: ", accountURL)
+	for _, m := range cfg.meters {
+		ais = append(ais, newSample(m, project, cfg.region, header.Get(m.Header)))
+	}
+	ais = append(ais, policySamples(cfg.meters, project, cfg.region, header)...)
+	if ai, ok := quotaSample(project, cfg.region, header); ok {
+		ais = append(ais, ai)
 	}
+	tagAccount(ais, account)
+	return ais, "", mode, nil
 }
 
-// PollWorker is a goroutine that polls swift for projects from chann Project. Exits on context.Done()
-func PollWorker(wg *sync.WaitGroup, objectStoreURL, region string, in <-chan Project,
-	provider *gophercloud.ProviderClient, out chan AccountResult) {
+// headAccountConsistent sends the HEAD of an account to the proxies with the configured
+// consistency. In fallback mode, a drop of the bytes used since the previous run is
+// checked against the newest replica before being believed.
+func headAccountConsistent(ctx context.Context, cfg *RegionPollConfig, account Account, sess *session,
+	ctl *concurrencyController) (http.Header, string, string, error) {
+
+	accountURL := cfg.accountURL(account)
+	mode := cfg.consistency.mode(account.Project)
+	header, class, err := headAccount(ctx, accountURL, mode == consistencyNewest, cfg.retry, sess, ctl)
+	if err != nil || cfg.consistency.newest != newestFallback {
+		return header, class, mode, err
+	}
+	key := cfg.region + "/" + account.String()
+	if !cfg.history.dropped(key, header, cfg.consistency.dropThreshold) {
+		return header, class, mode, err
+	}
+	log.Infof("Usage of account %s dropped since the previous run, asking for the newest replica", account)
+	newest, class, err := headAccount(ctx, accountURL, true, cfg.retry, sess, ctl)
+	if err != nil {
+		log.Errorf("Newest replica of account %s: %v", account, err)
+		return header, "", consistencyFallback, nil
+	}
+	cfg.history.record(key, newest)
+	return newest, class, consistencyFallback, nil
+}
+
+// PollWorker is a goroutine that polls swift for projects from chann Project.
+// Requests in flight are cancelled on ctx.Done() and their project reported as skipped.
+func PollWorker(ctx context.Context, wg *sync.WaitGroup, cfg *RegionPollConfig, in <-chan Account,
+	sess *session, ctl *concurrencyController, out chan AccountResult) {
 
 	defer wg.Done()
 	//var errors int
-	for project := range in {
-		ai, err := pollProject(objectStoreURL, region, project, provider)
-		out <- AccountResult{ai, err}
+	for account := range in {
+		ctl.acquire()
+		ais, class, mode, err := pollAccount(ctx, cfg, account, sess, ctl)
+		var audit *auditResult
+		// radosgw containers come with the bucket stats polled by pollAccount.
+		wantContainers := cfg.rgw == nil && cfg.containers.wants(account.Project)
+		wantAudit := cfg.rgw == nil && cfg.audit.wants()
+		if err == nil && class != failureNotFound && (wantContainers || wantAudit) {
+			containers, err := listContainers(ctx, cfg.accountURL(account), sess)
+			if err != nil {
+				log.Errorf("cannot list containers of account %v: %v", account, err)
+			} else {
+				if wantAudit {
+					if res, ok := auditAccount(cfg.audit, account, ais, containers); ok {
+						audit = &res
+					}
+				}
+				if wantContainers {
+					samples := containerSamples(containers, account.Project, cfg.region)
+					tagAccount(samples, account)
+					ais = append(ais, samples...)
+				}
+			}
+		}
+		ctl.release()
+		if err != nil && ctx.Err() != nil {
+			out <- AccountResult{err: err, skipped: true}
+			continue
+		}
+		out <- AccountResult{ais: ais, class: class, consistency: mode, audit: audit, err: err}
 	}
 }
 
 // PollRegion polls a region. should run in its own goroutine
-func PollRegion(cfg *RegionPollConfig, projects []Project, provider *gophercloud.ProviderClient) (RegionReport, error) {
+func PollRegion(cfg *RegionPollConfig, accounts []Account, sess *session) (RegionReport, error) {
 
-	projChann := make(chan Project)
-	accountResultChann := make(chan AccountResult, len(projects))
+	accountChann := make(chan Account)
+	accountResultChann := make(chan AccountResult, len(accounts))
 
+	// We start as many workers as we could ever need, the controller decides how many actually poll.
+	ctl := newConcurrencyController(cfg.minWorkers, cfg.maxWorkers, cfg.workers, len(accounts))
 	var wg sync.WaitGroup
-	for i := 0; i < cfg.workers; i++ {
+	ctxSwift, cancel := context.WithTimeout(context.Background(), cfg.timeout*tsSwift/tsSum)
+	for i := 0; i < cfg.maxWorkers; i++ {
 		wg.Add(1)
-		go PollWorker(&wg, cfg.objectStoreUrl, cfg.region, projChann, provider, accountResultChann)
+		go PollWorker(ctxSwift, &wg, cfg, accountChann, sess, ctl, accountResultChann)
 	}
 
-	ctxSwift, cancel := context.WithTimeout(context.Background(), cfg.timeout*tsSwift/tsSum)
+	if cfg.minWorkers < cfg.maxWorkers {
+		go func() {
+			deadline, _ := ctxSwift.Deadline()
+			ticker := time.NewTicker(concurrencyAdjustInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctxSwift.Done():
+					return
+				case <-ticker.C:
+					ctl.adjust(concurrencyAdjustInterval, deadline.Sub(time.Now()))
+				}
+			}
+		}()
+	}
+
+	// Accounts never handed to a worker because time ran out.
+	// Only read once accountResultChann is closed, which happens after accountChann is.
+	var unsent int
 	go func() {
-		defer close(projChann)
-		defer cancel()
-		for _, p := range projects {
+		defer close(accountChann)
+		for i, a := range accounts {
 			select {
 			case <-ctxSwift.Done():
+				unsent = len(accounts) - i
 				return
-			case projChann <- p:
+			case accountChann <- a:
 			}
 		}
 	}()
@@ -217,62 +478,155 @@ func PollRegion(cfg *RegionPollConfig, projects []Project, provider *gophercloud
 	go func() {
 		// Wait for all workers to finish. If context is canceled, Workers will exit and this will pass.
 		wg.Wait()
+		cancel()
 		close(accountResultChann) // Then we close this chan to terminate the publishing.
 	}()
 
 	rr, err := ReduceAccounts(cfg, accountResultChann)
+	rr.Concurrency, rr.PeakConcurrency = ctl.current()
+	rr.Skipped += unsent
+	if rr.Skipped > 0 {
+		log.Warnf("Skipped %d accounts in region %v: swift polling ran out of time", rr.Skipped, cfg.region)
+	}
 
 	return rr, err
 
 }
 
-func runOnce(conf config) {
+func runOnce(conf config, sess *session, tracker *regionTracker, history *usageHistory) {
 	start := time.Now()
 
-	provider, err := openstack.AuthenticatedClient(conf.Credentials.Openstack.AuthOptions)
-	if err != nil {
-		log.Fatalf("Failed creating provider: %v", err)
+	// The token is reused across runs while it is valid.
+	if _, err := sess.token(); err != nil {
+		log.Fatalf("Failed authenticating: %v", err)
 	}
-
-	idClient, err := openstack.NewIdentityV3(provider, gophercloud.EndpointOpts{})
-	if err != nil {
-		log.Fatalf("cannot get identity client: %v", err)
+	// Without keystone, only the configured accounts are polled.
+	var projects []Project
+	if conf.Credentials.Openstack.AuthType != authV1 {
+		var err error
+		projects, err = getProjects(sess, conf.Projects)
+		if err != nil {
+			log.Fatalf("Could not get projects: %v", err)
+		}
+		log.Info(len(projects), " projects retrieved")
 	}
-	projects, err := getProjects(idClient)
-	if err != nil {
-		log.Fatalf("Could not get projects: %v", err)
+	accounts := buildAccounts(projects, conf.ResellerPrefixes, conf.MappedAccounts)
+
+	regions := conf.Regions
+	if conf.RegionDiscovery {
+		names, err := objectStoreRegions(conf, sess)
+		if err != nil {
+			log.Fatalf("Could not discover regions: %v", err)
+		}
+		added, removed := tracker.update(names)
+		log.Infof("Discovered %d regions: %v", len(names), names)
+		if len(added) > 0 || len(removed) > 0 {
+			log.Warnf("Regions changed since last run. Added: %v Removed: %v", added, removed)
+		}
+		regions = discoverRegions(conf, names)
 	}
 
-	log.Info(len(projects), " projects retrieved")
+	// Regions are polled concurrently, sharing the token and the project listing.
+	reports := make([]RegionReport, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func(i int, region regionConfig) {
+			defer wg.Done()
+			reports[i] = runRegion(conf, region, sess, projects, accounts, history, start)
+		}(i, region)
+	}
+	wg.Wait()
 
-	objectStoreURL, err := getEndpoint(idClient, "object-store", conf.Region, "admin")
+	graphiteClient, err := graphite.NewGraphiteWithMetricPrefix(conf.Graphite.Hostname, conf.Graphite.Port, conf.Graphite.Prefix)
 	if err != nil {
-		log.Fatalf("cannot get swift endpoint for region: %v", conf.Region)
+		log.Errorf("cannot connect to graphite with hostname: %v port: %v", conf.Graphite.Hostname, conf.Graphite.Port)
+		graphiteClient = graphite.NewGraphiteNop(conf.Graphite.Hostname, conf.Graphite.Port)
+	}
+	for _, report := range reports {
+		report.Publish(graphiteClient)
+	}
+	if conf.RegionDiscovery {
+		tracker.Publish(graphiteClient)
+	}
+}
+
+// runRegion polls a single region and returns its report.
+func runRegion(conf config, region regionConfig, sess *session, projects []Project, accounts []Account,
+	history *usageHistory, start time.Time) RegionReport {
+
+	var objectStoreURL string
+	var rgw *rgwClient
+	var ring *accountRing
+	switch region.Backend {
+	case backendRGW:
+		rgw = newRGWClient(region.RGWEndpoint, conf.RGW, conf.Retry.RequestTimeout)
+		accounts = rgw.distinctUsers(accounts)
+	case backendRing:
+		// The ring is read on every run to follow rebalances.
+		var err error
+		ring, err = loadRing(region.AccountRing, conf.Ring)
+		if err != nil {
+			log.Errorf("cannot load account ring %v for region %v: %v", region.AccountRing, region.Name, err)
+			return RegionReport{Region: region.Name, Projects: len(projects), Accounts: len(accounts), RunDuration: time.Since(start)}
+		}
+	default:
+		var err error
+		objectStoreURL, err = resolveObjectStoreURL(conf, region, sess)
+		if err != nil {
+			log.Errorf("cannot get swift endpoint for region %v: %v", region.Name, err)
+			return RegionReport{Region: region.Name, Projects: len(projects), Accounts: len(accounts), RunDuration: time.Since(start)}
+		}
 	}
 
 	cfg := RegionPollConfig{
 		objectStoreUrl: objectStoreURL,
-		timeout:        conf.Timeout,
-		region:         conf.Region,
-		workers:        conf.Workers,
-		rabbit:         conf.Credentials.Rabbit,
+		timeout:        region.Timeout,
+		region:         region.Name,
+		workers:        region.Workers,
+		minWorkers:     region.MinWorkers,
+		maxWorkers:     region.MaxWorkers,
+		retry:          conf.Retry,
+		publishers:     newPublishers(conf.Publishers, region.Rabbit),
+		meters:         conf.Meters,
+		containers:     conf.Containers,
+		rgw:            rgw,
+		ring:           ring,
+		audit:          conf.Audit,
+		consistency:    conf.Consistency,
+		history:        history,
 	}
 
-	report, err := PollRegion(&cfg, projects, provider)
-	if err != nil {
-		log.Errorf("cannot publish result: %v", err)
+	// Recon is polled alongside the accounts, within the same deadline.
+	var recon chan reconReport
+	if conf.Recon {
+		hosts, err := reconHosts(region.ReconNodes, region.ReconRing)
+		if err != nil {
+			log.Errorf("cannot get recon nodes for region %v: %v", region.Name, err)
+		} else if len(hosts) > 0 {
+			recon = make(chan reconReport, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), region.Timeout*tsSwift/tsSum)
+				defer cancel()
+				recon <- pollRecon(ctx, hosts, conf.Retry.RequestTimeout)
+			}()
+		}
 	}
 
+	report, err := PollRegion(&cfg, accounts, sess)
+	if err != nil {
+		log.Errorf("cannot publish result for region %v: %v", region.Name, err)
+	}
+	if recon != nil {
+		r := <-recon
+		report.Recon = &r
+	}
 	report.RunDuration = time.Since(start)
 	report.Projects = len(projects)
+	report.Accounts = len(accounts)
 
-	log.Infof("Run Completed in %v. Successfully Polled %v out of %v accounts. Published %d", report.RunDuration.String(), report.PolledSuccessfully, report.Projects, report.Published)
-	graphiteClient, err := graphite.NewGraphiteWithMetricPrefix(conf.Graphite.Hostname, conf.Graphite.Port, conf.Graphite.Prefix)
-	if err != nil {
-		log.Errorf("cannot connect to graphite with hostname: %v port: %v", conf.Graphite.Hostname, conf.Graphite.Port)
-		graphiteClient = graphite.NewGraphiteNop(conf.Graphite.Hostname, conf.Graphite.Port)
-	}
-	report.Publish(graphiteClient)
+	log.Infof("Run Completed for region %v in %v. Successfully Polled %v out of %v accounts. Published %v samples out of %v", region.Name, report.RunDuration.String(), report.PolledSuccessfully, report.Accounts, report.Published, report.Samples)
+	return report
 }
 
 func main() {
@@ -297,12 +651,16 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
+	sess := newSession(conf.Credentials.Openstack, conf.TokenRefreshMargin)
+	tracker := &regionTracker{}
+	history := newUsageHistory()
+
 	// This works around the fact that tickers start after one full interval.
-	go runOnce(conf)
+	go runOnce(conf, sess, tracker, history)
 	for {
 		select {
 		case <-ticker:
-			go runOnce(conf)
+			go runOnce(conf, sess, tracker, history)
 		case <-sig:
 			os.Exit(1)
 		}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// meter describes a sample derived from the headers of an account HEAD.
+type meter struct {
+	Name       string // ceilometer counter name
+	PolicyName string // counter name of the per storage policy sample
+	Unit       string // ceilometer counter unit
+	Header     string // account header carrying the value
+	Graphite   string // name of the regional total published to graphite
+}
+
+var availableMeters = []meter{
+	{Name: "storage.objects.size", PolicyName: "storage.policy.objects.size", Unit: "B",
+		Header: "X-Account-Bytes-Used", Graphite: "totalconso"},
+	{Name: "storage.objects", PolicyName: "storage.policy.objects", Unit: "object",
+		Header: "X-Account-Object-Count", Graphite: "totalobjects"},
+	{Name: "storage.objects.containers", PolicyName: "storage.policy.objects.containers", Unit: "container",
+		Header: "X-Account-Container-Count", Graphite: "totalcontainers"},
+}
+
+// Swift reports per policy usage as X-Account-Storage-Policy-<name>-Bytes-Used and so on.
+const policyHeaderPrefix = "X-Account-Storage-Policy-"
+
+// parseMeters returns the meters matching names. An empty list enables every meter.
+func parseMeters(names []string) ([]meter, error) {
+	if len(names) == 0 {
+		return availableMeters, nil
+	}
+	var meters []meter
+	for _, name := range names {
+		found := false
+		for _, m := range availableMeters {
+			if m.Name == name {
+				meters = append(meters, m)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown meter %s", name)
+		}
+	}
+	return meters, nil
+}
+
+func newSample(m meter, project Project, region, volume string) AccountInfo {
+	return AccountInfo{
+		CounterName:      m.Name,
+		ResourceID:       project.ID,
+		MessageID:        uuid.New(),
+		Timestamp:        time.Now().Format(time.RFC3339),
+		CounterVolume:    volume,
+		UserID:           nil,
+		Source:           "openstack",
+		CounterUnit:      m.Unit,
+		ProjectID:        project.ID,
+		CounterType:      "gauge",
+		ResourceMetadata: nil,
+		Region:           region,
+	}
+}
+
+// policySamples returns one sample per storage policy and meter found in the account headers.
+// The policy name is stored in the resource metadata under "storage_policy".
+func policySamples(meters []meter, project Project, region string, header http.Header) []AccountInfo {
+	var keys []string
+	for key := range header {
+		if strings.HasPrefix(key, policyHeaderPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var ais []AccountInfo
+	for _, key := range keys {
+		for _, m := range meters {
+			suffix := "-" + strings.TrimPrefix(m.Header, "X-Account-")
+			if !strings.HasSuffix(key, suffix) {
+				continue
+			}
+			policy := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(key, policyHeaderPrefix), suffix))
+			ai := newSample(m, project, region, header.Get(key))
+			ai.CounterName = m.PolicyName
+			ai.ResourceMetadata = map[string]string{"storage_policy": policy}
+			ais = append(ais, ai)
+		}
+	}
+	return ais
+}
+
+// meterName maps a per policy counter name back to the name of its meter.
+func meterName(counterName string) string {
+	for _, m := range availableMeters {
+		if m.PolicyName == counterName {
+			return m.Name
+		}
+	}
+	return counterName
+}
+
+// Accounts using the account_quotas middleware expose their quota in this header.
+const quotaHeader = "X-Account-Meta-Quota-Bytes"
+
+var quotaMeter = meter{Name: "storage.quota.utilization", Unit: "ratio"}
+
+// quotaSample returns the ratio of bytes used over the account quota. The quota itself
+// is stored in the resource metadata under "quota_bytes". ok is false when the account
+// has no quota set.
+func quotaSample(project Project, region string, header http.Header) (ai AccountInfo, ok bool) {
+	quota, err := strconv.ParseInt(header.Get(quotaHeader), 10, 64)
+	if err != nil || quota <= 0 {
+		return ai, false
+	}
+	used, err := strconv.ParseInt(header.Get("X-Account-Bytes-Used"), 10, 64)
+	if err != nil {
+		return ai, false
+	}
+	ai = newSample(quotaMeter, project, region, strconv.FormatFloat(float64(used)/float64(quota), 'f', 4, 64))
+	ai.ResourceMetadata = map[string]string{"quota_bytes": strconv.FormatInt(quota, 10)}
+	return ai, true
+}
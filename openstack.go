@@ -5,27 +5,34 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 
-	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/identity/v2/tenants"
+	"github.com/gophercloud/gophercloud/pagination"
 	"github.com/pkg/errors"
 )
 
-func serviceGet(client *gophercloud.ServiceClient, path string) ([]byte, error) {
-	token := client.TokenID
-	URL := strings.Join([]string{client.ServiceURL(), path}, "")
+func serviceGet(sess *session, path string) ([]byte, error) {
+	client, err := sess.identity()
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "Could not get identity client")
+	}
+	return serviceGetURL(sess, strings.Join([]string{client.ServiceURL(), path}, ""))
+}
+
+func serviceGetURL(sess *session, URL string) ([]byte, error) {
 	req, err := http.NewRequest("GET", URL, nil)
 	if err != nil {
 		return []byte{}, errors.Wrap(err, "Failed creating request")
 	}
-	req.Header.Set("X-Auth-Token", token)
-	httpClient := &http.Client{}
-	resp, err := httpClient.Do(req)
+	resp, err := sess.do(req, &sess.httpClient)
 	if err != nil {
 		return []byte{}, errors.Wrap(err, "Request failed")
 	}
 	if status := resp.StatusCode; status != http.StatusOK {
-		return []byte{}, fmt.Errorf("Bad response status when getting %s (expecting 200 OK): %s", path, resp.Status)
+		resp.Body.Close()
+		return []byte{}, fmt.Errorf("Bad response status when getting %s (expecting 200 OK): %s", URL, resp.Status)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
@@ -53,8 +60,8 @@ type servicesCatalog struct {
 	} `json:"links"`
 }
 
-func getServiceID(client *gophercloud.ServiceClient, serviceType string) (string, error) {
-	body, err := serviceGet(client, "services")
+func getServiceID(sess *session, serviceType string) (string, error) {
+	body, err := serviceGet(sess, "services")
 	if err != nil {
 		return "", errors.Wrap(err, "Could not get sercices")
 	}
@@ -69,7 +76,10 @@ func getServiceID(client *gophercloud.ServiceClient, serviceType string) (string
 		}
 	}
 	if len(result) > 1 {
-		return "", fmt.Errorf(" %v\nMultiple services available with same name", result)
+		return "", fmt.Errorf("Multiple services available with type %s: %v", serviceType, result)
+	}
+	if len(result) < 1 {
+		return "", fmt.Errorf("No service with type %s", serviceType)
 	}
 	return result[0], nil
 }
@@ -93,8 +103,8 @@ type endpointsCatalog struct {
 	} `json:"links"`
 }
 
-func getEndpoint(client *gophercloud.ServiceClient, serviceType string, region string, eInterface string) (string, error) {
-	body, err := serviceGet(client, "endpoints")
+func getEndpoint(sess *session, serviceType string, region string, eInterface string) (string, error) {
+	body, err := serviceGet(sess, "endpoints")
 	if err != nil {
 		return "", errors.Wrap(err, "Could not get endpoints")
 	}
@@ -102,13 +112,13 @@ func getEndpoint(client *gophercloud.ServiceClient, serviceType string, region s
 	if err = json.Unmarshal(body, &c); err != nil {
 		return "", errors.Wrap(err, "Failed unmarshalling endpoint catalog")
 	}
-	serviceID, err := getServiceID(client, serviceType)
+	serviceID, err := getServiceID(sess, serviceType)
 	if err != nil {
 		return "", errors.Wrap(err, "Could not get serviceID")
 	}
 	var result []string
 	for _, endpoint := range c.Endpoints {
-		if endpoint.Region == region && endpoint.ServiceID == serviceID && endpoint.Interface == eInterface {
+		if endpoint.Enabled && endpoint.Region == region && endpoint.ServiceID == serviceID && endpoint.Interface == eInterface {
 			result = append(result, endpoint.URL)
 		}
 	}
@@ -126,20 +136,109 @@ type Project struct {
 	Enabled  bool   `json:"enabled"`   //true,
 	ID       string `json:"id"`        //"0c4e939acacf4376bdcd1129f1a054ad",
 	Name     string `json:"name"`      //"admin",
+	IsDomain bool   `json:"is_domain"` //false,
 }
 
 type projectsList struct {
 	Projects []Project `json:"projects"`
+	Links    struct {
+		Self     string  `json:"self"`
+		Previous *string `json:"previous"`
+		Next     *string `json:"next"`
+	} `json:"links"`
 }
 
-func getProjects(client *gophercloud.ServiceClient) ([]Project, error) {
-	var c projectsList
-	body, err := serviceGet(client, "projects")
+// getProjects lists the projects matching filter. With keystone v2, tenants are listed instead.
+func getProjects(sess *session, filter projectFilter) ([]Project, error) {
+	var projects []Project
+	var err error
+	if sess.creds.AuthType == authV2Password {
+		projects, err = getTenants(sess)
+	} else {
+		projects, err = listProjects(sess, filter)
+	}
 	if err != nil {
-		return c.Projects, errors.Wrap(err, "Could not get projects")
+		return nil, err
 	}
-	if err := json.Unmarshal(body, &c); err != nil {
-		return c.Projects, errors.Wrap(err, "Failed unmarshalling projects")
+
+	var kept []Project
+	for _, p := range projects {
+		if filter.keep(p) {
+			kept = append(kept, p)
+		}
+	}
+	if excluded := len(projects) - len(kept); excluded > 0 {
+		log.Infof("Excluded %d projects out of %d", excluded, len(projects))
+	}
+	return kept, nil
+}
+
+// listProjects lists the v3 projects, following links.next through every page.
+func listProjects(sess *session, filter projectFilter) ([]Project, error) {
+	var projects []Project
+	body, err := serviceGet(sess, "projects"+filter.query())
+	for page := 1; ; page++ {
+		if err != nil {
+			return projects, errors.Wrapf(err, "Could not get projects page %d", page)
+		}
+		var c projectsList
+		if err := json.Unmarshal(body, &c); err != nil {
+			return projects, errors.Wrap(err, "Failed unmarshalling projects")
+		}
+		projects = append(projects, c.Projects...)
+		if c.Links.Next == nil || *c.Links.Next == "" || len(c.Projects) == 0 {
+			break
+		}
+		body, err = serviceGetURL(sess, *c.Links.Next)
+	}
+	return projects, nil
+}
+
+// getTenants lists the v2 tenants as projects of the default domain.
+func getTenants(sess *session) ([]Project, error) {
+	client, err := sess.identity()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get identity client")
+	}
+	var projects []Project
+	err = tenants.List(client, nil).EachPage(func(page pagination.Page) (bool, error) {
+		list, err := tenants.ExtractTenants(page)
+		if err != nil {
+			return false, err
+		}
+		for _, t := range list {
+			projects = append(projects, Project{DomainID: "default", Enabled: t.Enabled, ID: t.ID, Name: t.Name})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return projects, errors.Wrap(err, "Could not get tenants")
+	}
+	return projects, nil
+}
+
+// getRegions returns the sorted regions having an enabled endpoint for serviceType with the given interface.
+func getRegions(sess *session, serviceType string, eInterface string) ([]string, error) {
+	body, err := serviceGet(sess, "endpoints")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get endpoints")
+	}
+	var c endpointsCatalog
+	if err = json.Unmarshal(body, &c); err != nil {
+		return nil, errors.Wrap(err, "Failed unmarshalling endpoint catalog")
+	}
+	serviceID, err := getServiceID(sess, serviceType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get serviceID")
+	}
+	seen := make(map[string]bool)
+	var regions []string
+	for _, endpoint := range c.Endpoints {
+		if endpoint.Enabled && endpoint.ServiceID == serviceID && endpoint.Interface == eInterface && !seen[endpoint.Region] {
+			seen[endpoint.Region] = true
+			regions = append(regions, endpoint.Region)
+		}
 	}
-	return c.Projects, nil
+	sort.Strings(regions)
+	return regions, nil
 }
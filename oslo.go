@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Envelopes of the messages published to rabbit.
+const (
+	envelopeNone = "none" // {"args": {"data": samples}}
+	envelopeV1   = "1.0"  // oslo.messaging cast of record_metering_data, as sent by ceilometer
+	envelopeV2   = "2.0"  // the same cast serialized in an oslo.messaging v2 envelope
+)
+
+// Modes of the rabbit publisher.
+const (
+	rabbitModeRPC          = "rpc"          // casts to the collector queue
+	rabbitModeNotification = "notification" // oslo notifications
+)
+
+// Priorities of oslo notifications, the routing key ending with the lower case priority.
+var notificationPriorities = []string{"audit", "debug", "info", "warn", "warning", "error", "critical", "sample"}
+
+// osloContext is the request context of the messages, sent as _context_ keys.
+type osloContext struct {
+	RequestID string  `json:"_context_request_id"`
+	User      *string `json:"_context_user"`
+	Tenant    *string `json:"_context_tenant"`
+	IsAdmin   bool    `json:"_context_is_admin"`
+	ReadOnly  bool    `json:"_context_read_only"`
+}
+
+// osloMessage is the cast of record_metering_data handled by the ceilometer collectors.
+type osloMessage struct {
+	osloContext
+	Method    string  `json:"method"`
+	Namespace *string `json:"namespace"`
+	Version   string  `json:"version"`
+	Args      struct {
+		Data interface{} `json:"data"`
+	} `json:"args"`
+	UniqueID string `json:"_unique_id"`
+}
+
+// osloNotification carries the samples in its payload, as the ceilometer notifier publisher.
+type osloNotification struct {
+	osloContext
+	MessageID   string `json:"message_id"`
+	PublisherID string `json:"publisher_id"`
+	EventType   string `json:"event_type"`
+	Priority    string `json:"priority"`
+	Payload     struct {
+		Samples interface{} `json:"samples"`
+	} `json:"payload"`
+	Timestamp string `json:"timestamp"`
+	UniqueID  string `json:"_unique_id"`
+}
+
+type osloEnvelope struct {
+	Version string `json:"oslo.version"`
+	Message string `json:"oslo.message"`
+}
+
+// destination returns the exchange and the routing key of the messages.
+func (r rabbitCreds) destination() (exchange, routingKey string) {
+	if r.Mode == rabbitModeNotification {
+		return r.NotificationExchange, r.NotificationTopic + "." + strings.ToLower(r.Priority)
+	}
+	return r.Exchange, r.RoutingKey
+}
+
+// rabbitBody returns the body of the message carrying a chunk of samples, every sample
+// being signed with the metering secret unless empty. Notifications are sent without
+// envelope when the envelope is none.
+func rabbitBody(rabbit rabbitCreds, ais []AccountInfo) ([]byte, error) {
+	var samples interface{} = ais
+	legacy := rabbit.Mode != rabbitModeNotification && (rabbit.Envelope == envelopeNone || rabbit.Envelope == "")
+	if !legacy || rabbit.MeteringSecret != "" {
+		ceilometerSamples, err := toCeilometerSamples(ais)
+		if err != nil {
+			return nil, err
+		}
+		if rabbit.MeteringSecret != "" {
+			signSamples(rabbit.MeteringSecret, ceilometerSamples)
+		}
+		samples = ceilometerSamples
+	}
+
+	reqContext := osloContext{RequestID: "req-" + uuid.New(), IsAdmin: true}
+	uniqueID := strings.Replace(uuid.New(), "-", "", -1)
+	var msg interface{}
+	switch {
+	case rabbit.Mode == rabbitModeNotification:
+		n := osloNotification{
+			osloContext: reqContext,
+			MessageID:   uuid.New(),
+			PublisherID: rabbit.PublisherID,
+			EventType:   rabbit.EventType,
+			Priority:    strings.ToUpper(rabbit.Priority),
+			Timestamp:   time.Now().UTC().Format("2006-01-02 15:04:05.000000"),
+			UniqueID:    uniqueID,
+		}
+		n.Payload.Samples = samples
+		msg = n
+	case legacy:
+		output := rabbitPayload{}
+		output.Args.Data = samples
+		return json.Marshal(output)
+	default:
+		m := osloMessage{
+			osloContext: reqContext,
+			Method:      "record_metering_data",
+			Version:     "1.0",
+			UniqueID:    uniqueID,
+		}
+		m.Args.Data = samples
+		msg = m
+	}
+	body, err := json.Marshal(msg)
+	if err != nil || rabbit.Envelope != envelopeV2 {
+		return body, err
+	}
+	return json.Marshal(osloEnvelope{Version: envelopeV2, Message: string(body)})
+}
+
+// toCeilometerSamples returns the samples as JSON objects with the resource_metadata
+// key read by ceilometer, AccountInfo keeping its historical ressource_metadata.
+func toCeilometerSamples(ais []AccountInfo) ([]map[string]interface{}, error) {
+	samples := make([]map[string]interface{}, 0, len(ais))
+	for _, ai := range ais {
+		b, err := json.Marshal(ai)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		var sample map[string]interface{}
+		if err := decoder.Decode(&sample); err != nil {
+			return nil, err
+		}
+		sample["resource_metadata"] = sample["ressource_metadata"]
+		delete(sample, "ressource_metadata")
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// signSamples adds their message_signature to the samples. The signature is computed
+// on the JSON form of the sample, as the collector does when verifying it.
+func signSamples(secret string, samples []map[string]interface{}) {
+	for _, sample := range samples {
+		sample["message_signature"] = meteringSignature(secret, sample)
+	}
+}
+
+// meteringSignature is the compute_signature of ceilometer: the HMAC-SHA256 of the
+// names and values of the sample, sorted by name, nested maps being flattened with
+// their keys joined by colons.
+func meteringSignature(secret string, sample map[string]interface{}) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	keypairs(sample, "", func(name string, value interface{}) {
+		if name == "message_signature" {
+			return
+		}
+		mac.Write([]byte(name))
+		mac.Write([]byte(pythonString(value)))
+	})
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keypairs calls f on the values of m sorted by name, recursing into maps.
+func keypairs(m map[string]interface{}, prefix string, f func(string, interface{})) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sub, ok := m[name].(map[string]interface{}); ok {
+			keypairs(sub, prefix+name+":", f)
+			continue
+		}
+		f(prefix+name, m[name])
+	}
+}
+
+// pythonString formats a decoded JSON value as python's str does.
+func pythonString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
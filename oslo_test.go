@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+// The digest is the one computed by ceilometer.publisher.utils.compute_signature on
+// the same sample with the same secret.
+func TestMeteringSignature(t *testing.T) {
+	ai := AccountInfo{
+		CounterName:      "storage.objects.size",
+		ResourceID:       "d5bbc7c06c9e479dbb91912c045cdeab",
+		MessageID:        "1",
+		Timestamp:        "2013-05-13T14:03:01Z",
+		CounterVolume:    "1024",
+		Source:           "openstack",
+		CounterUnit:      "B",
+		ProjectID:        "d5bbc7c06c9e479dbb91912c045cdeab",
+		CounterType:      "gauge",
+		ResourceMetadata: map[string]string{"storage_policy": "gold", "reseller_prefix": "AUTH_"},
+		Region:           "int5",
+	}
+	samples, err := toCeilometerSamples([]AccountInfo{ai})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signSamples("metering-secret", samples)
+
+	const want = "873f3e31fed99f1876266e10407a0c416093c6c4dc3dc787d713b685aecf8929"
+	if got := samples[0]["message_signature"]; got != want {
+		t.Errorf("message_signature = %v, want %v", got, want)
+	}
+	if _, ok := samples[0]["ressource_metadata"]; ok {
+		t.Errorf("sample still has ressource_metadata")
+	}
+	// Signing again must skip the signature already set.
+	if got := meteringSignature("metering-secret", samples[0]); got != want {
+		t.Errorf("signature of a signed sample = %v, want %v", got, want)
+	}
+}
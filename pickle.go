@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+)
+
+// unpickle decodes the subset of the python pickle protocols 2 to 4 used by swift
+// to save rings: dicts, lists, tuples, strings, numbers and array.array objects.
+// Arrays are returned as []int, dicts as map[string]interface{} and integers as int64.
+func unpickle(r io.Reader) (interface{}, error) {
+	u := unpickler{r: bufio.NewReader(r), memo: make(map[int]interface{})}
+	v, err := u.run()
+	if err != nil {
+		return nil, err
+	}
+	return plainLists(v), nil
+}
+
+// pickleList is a list being decoded. Lists are shared with the memo and
+// grow after being memoized, hence the pointer.
+type pickleList struct {
+	items []interface{}
+}
+
+// plainLists replaces the pickleLists of v by slices.
+func plainLists(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *pickleList:
+		return plainLists(v.items)
+	case []interface{}:
+		plain := make([]interface{}, len(v))
+		for i, item := range v {
+			plain[i] = plainLists(item)
+		}
+		return plain
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = plainLists(item)
+		}
+	}
+	return v
+}
+
+// pickleMark separates the items of a MARK from the rest of the stack.
+type pickleMark struct{}
+
+// pickleGlobal is a class or function referenced by the pickle.
+type pickleGlobal struct {
+	module, name string
+}
+
+type unpickler struct {
+	r     *bufio.Reader
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+func (u *unpickler) push(v interface{}) { u.stack = append(u.stack, v) }
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("pickle stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("pickle stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark returns the items pushed since the last MARK.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("pickle mark not found")
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(u.r, b)
+	return b, err
+}
+
+func (u *unpickler) uint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) line() (string, error) {
+	s, err := u.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return s[:len(s)-1], nil
+}
+
+// sized reads a length of n bytes followed by as many bytes.
+func (u *unpickler) sized(n int) ([]byte, error) {
+	size, err := u.uint(n)
+	if err != nil {
+		return nil, err
+	}
+	return u.read(int(size))
+}
+
+func (u *unpickler) run() (interface{}, error) {
+	for {
+		op, err := u.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case 0x80: // PROTO
+			if _, err := u.r.ReadByte(); err != nil {
+				return nil, err
+			}
+		case 0x95: // FRAME
+			if _, err := u.read(8); err != nil {
+				return nil, err
+			}
+		case '.': // STOP
+			return u.pop()
+		case '(': // MARK
+			u.push(pickleMark{})
+		case 'N':
+			u.push(nil)
+		case 0x88:
+			u.push(true)
+		case 0x89:
+			u.push(false)
+		case 'K': // BININT1
+			v, err := u.uint(1)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(v))
+		case 'M': // BININT2
+			v, err := u.uint(2)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(v))
+		case 'J': // BININT
+			v, err := u.uint(4)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(int32(v)))
+		case 0x8a: // LONG1
+			b, err := u.sized(1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeLong(b)
+			if err != nil {
+				return nil, err
+			}
+			u.push(v)
+		case 'G': // BINFLOAT
+			b, err := u.read(8)
+			if err != nil {
+				return nil, err
+			}
+			u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			b, err := u.sized(1)
+			if err != nil {
+				return nil, err
+			}
+			u.push(string(b))
+		case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+			b, err := u.sized(4)
+			if err != nil {
+				return nil, err
+			}
+			u.push(string(b))
+		case '}': // EMPTY_DICT
+			u.push(make(map[string]interface{}))
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case ')': // EMPTY_TUPLE
+			u.push([]interface{}{})
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op-0x85) + 1
+			if len(u.stack) < n {
+				return nil, fmt.Errorf("pickle stack underflow")
+			}
+			tuple := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(tuple)
+		case 't': // TUPLE
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(items)
+		case 'l': // LIST
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(&pickleList{items})
+		case 'a': // APPEND
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.appendItems([]interface{}{v}); err != nil {
+				return nil, err
+			}
+		case 'e': // APPENDS
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.appendItems(items); err != nil {
+				return nil, err
+			}
+		case 's': // SETITEM
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			k, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.setItems([]interface{}{k, v}); err != nil {
+				return nil, err
+			}
+		case 'u': // SETITEMS
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.setItems(items); err != nil {
+				return nil, err
+			}
+		case 'q', 'r': // BINPUT, LONG_BINPUT
+			n := 1
+			if op == 'r' {
+				n = 4
+			}
+			i, err := u.uint(n)
+			if err != nil {
+				return nil, err
+			}
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.memo[int(i)] = v
+		case 0x94: // MEMOIZE
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.memo[len(u.memo)] = v
+		case 'h', 'j': // BINGET, LONG_BINGET
+			n := 1
+			if op == 'j' {
+				n = 4
+			}
+			i, err := u.uint(n)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := u.memo[int(i)]
+			if !ok {
+				return nil, fmt.Errorf("pickle memo %d not found", i)
+			}
+			u.push(v)
+		case 'c': // GLOBAL
+			module, err := u.line()
+			if err != nil {
+				return nil, err
+			}
+			name, err := u.line()
+			if err != nil {
+				return nil, err
+			}
+			u.push(pickleGlobal{module, name})
+		case 0x93: // STACK_GLOBAL
+			name, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			module, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			u.push(pickleGlobal{fmt.Sprint(module), fmt.Sprint(name)})
+		case 'R': // REDUCE
+			args, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			callable, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			v, err := reduce(callable, args)
+			if err != nil {
+				return nil, err
+			}
+			u.push(v)
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%02x", op)
+		}
+	}
+}
+
+func (u *unpickler) appendItems(items []interface{}) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	list, ok := v.(*pickleList)
+	if !ok {
+		return fmt.Errorf("pickle append to %T", v)
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) setItems(items []interface{}) error {
+	if len(items)%2 != 0 {
+		return fmt.Errorf("pickle odd number of dict items")
+	}
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("pickle setitem on %T", v)
+	}
+	for i := 0; i < len(items); i += 2 {
+		dict[fmt.Sprint(items[i])] = items[i+1]
+	}
+	return nil
+}
+
+// decodeLong decodes a little endian two's complement integer.
+func decodeLong(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	if v.BitLen() > 63 {
+		return 0, fmt.Errorf("pickle integer overflow")
+	}
+	return v.Int64(), nil
+}
+
+// reduce only knows how to rebuild arrays of unsigned integers, the machine
+// byte order being assumed little endian as on the hosts swift runs on.
+func reduce(callable, args interface{}) (interface{}, error) {
+	g, ok := callable.(pickleGlobal)
+	if !ok {
+		return nil, fmt.Errorf("pickle cannot call %T", callable)
+	}
+	a, _ := args.([]interface{})
+	switch {
+	case g.module == "array" && g.name == "array" && len(a) == 2:
+		// array(typecode, bytes) from python 2, array(typecode, list) from python 3.
+		typecode := fmt.Sprint(a[0])
+		switch items := a[1].(type) {
+		case string:
+			return arrayFromBytes(typecode, []byte(items))
+		case *pickleList:
+			ints := make([]int, len(items.items))
+			for i, item := range items.items {
+				n, ok := item.(int64)
+				if !ok {
+					return nil, fmt.Errorf("pickle array item %T", item)
+				}
+				ints[i] = int(n)
+			}
+			return ints, nil
+		}
+	case g.module == "array" && g.name == "_array_reconstructor" && len(a) == 4:
+		// _array_reconstructor(array, typecode, machine format, bytes) from python 3.
+		if s, ok := a[3].(string); ok {
+			return arrayFromBytes(fmt.Sprint(a[1]), []byte(s))
+		}
+	}
+	return nil, fmt.Errorf("pickle cannot call %s.%s", g.module, g.name)
+}
+
+func arrayFromBytes(typecode string, b []byte) ([]int, error) {
+	size := map[string]int{"B": 1, "H": 2, "I": 4, "L": 8}[typecode]
+	if size == 0 || len(b)%size != 0 {
+		return nil, fmt.Errorf("pickle unsupported array of %q", typecode)
+	}
+	ints := make([]int, len(b)/size)
+	for i := range ints {
+		var v uint64
+		for j := size - 1; j >= 0; j-- {
+			v = v<<8 | uint64(b[i*size+j])
+		}
+		ints[i] = int(v)
+	}
+	return ints, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// projectFilter selects the projects to poll. The first fields are sent to keystone
+// as query parameters, the others are applied to the listing it returns.
+type projectFilter struct {
+	DomainID string
+	Enabled  *bool
+	Tags     []string
+	IsDomain *bool
+
+	IncludeName *regexp.Regexp
+	ExcludeName *regexp.Regexp
+	IncludeID   *regexp.Regexp
+	ExcludeID   *regexp.Regexp
+	ExcludeIDs  map[string]bool
+}
+
+func (f projectFilter) query() string {
+	v := url.Values{}
+	if f.DomainID != "" {
+		v.Set("domain_id", f.DomainID)
+	}
+	if f.Enabled != nil {
+		v.Set("enabled", strconv.FormatBool(*f.Enabled))
+	}
+	if len(f.Tags) > 0 {
+		v.Set("tags", strings.Join(f.Tags, ","))
+	}
+	if f.IsDomain != nil {
+		v.Set("is_domain", strconv.FormatBool(*f.IsDomain))
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
+
+// keep tells whether p passes the filter. Server side filters are checked again
+// as older keystones ignore the ones they do not know.
+func (f projectFilter) keep(p Project) bool {
+	switch {
+	case f.DomainID != "" && p.DomainID != f.DomainID,
+		f.Enabled != nil && p.Enabled != *f.Enabled,
+		f.IsDomain != nil && p.IsDomain != *f.IsDomain,
+		f.IncludeName != nil && !f.IncludeName.MatchString(p.Name),
+		f.ExcludeName != nil && f.ExcludeName.MatchString(p.Name),
+		f.IncludeID != nil && !f.IncludeID.MatchString(p.ID),
+		f.ExcludeID != nil && f.ExcludeID.MatchString(p.ID),
+		f.ExcludeIDs[p.ID]:
+		return false
+	}
+	return true
+}
+
+func readProjectFilter() (projectFilter, error) {
+	var f projectFilter
+	f.DomainID = viper.GetString("projects.domain_id")
+	f.Tags = viper.GetStringSlice("projects.tags")
+	if viper.IsSet("projects.enabled") {
+		enabled := viper.GetBool("projects.enabled")
+		f.Enabled = &enabled
+	}
+	if viper.IsSet("projects.is_domain") {
+		isDomain := viper.GetBool("projects.is_domain")
+		f.IsDomain = &isDomain
+	}
+
+	regexps := []struct {
+		key string
+		re  **regexp.Regexp
+	}{
+		{"projects.include_name", &f.IncludeName},
+		{"projects.exclude_name", &f.ExcludeName},
+		{"projects.include_id", &f.IncludeID},
+		{"projects.exclude_id", &f.ExcludeID},
+	}
+	for _, r := range regexps {
+		if !viper.IsSet(r.key) {
+			continue
+		}
+		re, err := regexp.Compile(viper.GetString(r.key))
+		if err != nil {
+			return f, errors.Wrapf(err, "Bad regexp for %s", r.key)
+		}
+		*r.re = re
+	}
+
+	if path := viper.GetString("projects.exclude_ids_file"); path != "" {
+		ids, err := readIDFile(path)
+		if err != nil {
+			return f, errors.Wrap(err, "Could not read projects.exclude_ids_file")
+		}
+		f.ExcludeIDs = ids
+	}
+	return f, nil
+}
+
+// readIDFile reads one ID per line, ignoring blank lines and comments starting with #.
+func readIDFile(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = true
+	}
+	return ids, scanner.Err()
+}
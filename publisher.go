@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Publisher delivers the samples of a region. Setup returns a channel taking chunks of
+// samples and a channel on which the size of every delivered chunk is sent. The latter
+// is closed once the former is closed and its last chunk handled. ctx bounds the time
+// spent publishing, retries included.
+type Publisher interface {
+	Setup(ctx context.Context) (chan []AccountInfo, chan int, error)
+}
+
+// unroutableCounter is implemented by publishers detecting samples the broker could not route.
+// Unroutable is called once the confirm channel is closed.
+type unroutableCounter interface {
+	Unroutable() int
+}
+
+// Kinds of publishers.
+const (
+	publisherRabbit = "rabbit"
+	publisherStdout = "stdout" // JSON lines
+	publisherFile   = "file"   // rotating NDJSON file
+	publisherHTTP   = "http"   // POST of every chunk as a JSON array
+	publisherFake   = "fake"   // logs the chunks and drops them
+)
+
+type publisherConfig struct {
+	Name string // graphite name of the publisher, its type unless set
+	Type string
+	// Time given to publish the samples of a region, the rabbit share of the region timeout when 0.
+	Timeout time.Duration
+	// Overrides of the rabbit credentials of the region.
+	Rabbit interface{}
+	File   struct {
+		Path     string
+		MaxSize  int64 // bytes written before rotating
+		MaxFiles int   // rotated files kept, as Path.1 to Path.MaxFiles
+	}
+	HTTP struct {
+		URL     string
+		Timeout time.Duration
+	}
+}
+
+// regionPublisher is one of the publishers samples of a region are fanned out to.
+type regionPublisher struct {
+	Publisher
+	name    string
+	timeout time.Duration
+}
+
+func newPublishers(confs []publisherConfig, rabbit rabbitCreds) []regionPublisher {
+	var publishers []regionPublisher
+	for _, conf := range confs {
+		publishers = append(publishers, regionPublisher{Publisher: newPublisher(conf, rabbit), name: conf.Name, timeout: conf.Timeout})
+	}
+	return publishers
+}
+
+// newPublisher returns the publisher of a region, rabbit being the credentials of the region.
+func newPublisher(conf publisherConfig, rabbit rabbitCreds) Publisher {
+	if conf.Rabbit != nil {
+		// Checked by readPublishers.
+		overrideRabbit(&rabbit, conf.Rabbit)
+		rabbit.setURI()
+	}
+	switch conf.Type {
+	case publisherStdout:
+		return stdoutPublisher{}
+	case publisherFile:
+		return filePublisher{file: rotatingFileFor(conf.File.Path, conf.File.MaxSize, conf.File.MaxFiles)}
+	case publisherHTTP:
+		return httpPublisher{url: conf.HTTP.URL, client: http.Client{Timeout: conf.HTTP.Timeout}}
+	case publisherFake:
+		return fakePublisher{}
+	}
+	return &rabbitPublisher{rabbit: rabbit}
+}
+
+// writeLines writes the samples of every chunk as JSON lines to w, which is shared by the
+// regions: chunks are written whole under the lock.
+func writeLines(mu *sync.Mutex, w func([]byte) error, input <-chan []AccountInfo, confirm chan<- int) {
+	defer close(confirm)
+	for ais := range input {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, ai := range ais {
+			if err := encoder.Encode(ai); err != nil {
+				log.Errorf("cannot encode sample: %v", err)
+			}
+		}
+		mu.Lock()
+		err := w(buf.Bytes())
+		mu.Unlock()
+		if err != nil {
+			log.Errorf("Failed to publish samples: %v", err)
+			continue
+		}
+		confirm <- len(ais)
+	}
+}
+
+var stdoutMu sync.Mutex
+
+type stdoutPublisher struct{}
+
+// readPublishers parses the publishers list, defaults holding the settings of publisher.
+// Each entry needs a type, and may set a name, a timeout, rabbit overrides and the
+// settings of its type:
+//
+//	publishers:
+//	  - type: rabbit
+//	  - name: collector
+//	    type: http
+//	    url: "http://collector.service/samples"
+func readPublishers(defaults publisherConfig) ([]publisherConfig, error) {
+	if !viper.IsSet("publishers") {
+		return []publisherConfig{defaults}, nil
+	}
+	entries, ok := viper.Get("publishers").([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("publishers must be a list")
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("publishers cannot be empty")
+	}
+	names := make(map[string]bool)
+	var publishers []publisherConfig
+	for _, entry := range entries {
+		settings, ok := entry.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("publishers entries must be maps")
+		}
+		p := defaults
+		p.Name, p.Type, p.Timeout, p.Rabbit = "", "", 0, nil
+		for k, v := range settings {
+			value := fmt.Sprint(v)
+			var err error
+			switch fmt.Sprint(k) {
+			case "name":
+				p.Name = value
+			case "type":
+				p.Type = value
+			case "timeout":
+				p.Timeout, err = time.ParseDuration(value)
+			case "rabbit":
+				err = overrideRabbit(&rabbitCreds{}, v)
+				p.Rabbit = v
+			case "path":
+				p.File.Path = value
+			case "max_size":
+				p.File.MaxSize, err = strconv.ParseInt(value, 10, 64)
+			case "max_files":
+				p.File.MaxFiles, err = strconv.Atoi(value)
+			case "url":
+				p.HTTP.URL = value
+			case "request_timeout":
+				p.HTTP.Timeout, err = time.ParseDuration(value)
+			default:
+				err = fmt.Errorf("unknown key %v", k)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad setting %v for publisher %v", k, p.Name)
+			}
+		}
+		if p.Name == "" {
+			p.Name = p.Type
+		}
+		if err := p.check(); err != nil {
+			return nil, errors.Wrapf(err, "Bad publisher %v", p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("Duplicate publisher %v", p.Name)
+		}
+		names[p.Name] = true
+		publishers = append(publishers, p)
+	}
+	return publishers, nil
+}
+
+func (p publisherConfig) check() error {
+	switch p.Type {
+	case publisherFile:
+		if p.File.Path == "" {
+			return fmt.Errorf("path is needed with type %s", publisherFile)
+		}
+	case publisherHTTP:
+		if p.HTTP.URL == "" {
+			return fmt.Errorf("url is needed with type %s", publisherHTTP)
+		}
+	case publisherRabbit, publisherStdout, publisherFake:
+	default:
+		return fmt.Errorf("unknown type %s", p.Type)
+	}
+	return nil
+}
+
+func (stdoutPublisher) Setup(context.Context) (chan []AccountInfo, chan int, error) {
+	input := make(chan []AccountInfo)
+	confirm := make(chan int, 1)
+	go writeLines(&stdoutMu, func(b []byte) error {
+		_, err := os.Stdout.Write(b)
+		return err
+	}, input, confirm)
+	return input, confirm, nil
+}
+
+// rotatingFile is an append only file renamed to path.1 once it reaches maxSize,
+// the previous path.N becoming path.N+1 and the oldest being removed.
+type rotatingFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+var (
+	rotatingFilesMu sync.Mutex
+	rotatingFiles   = make(map[string]*rotatingFile)
+)
+
+// rotatingFileFor returns the rotatingFile of path, shared by the regions and the runs.
+func rotatingFileFor(path string, maxSize int64, maxFiles int) *rotatingFile {
+	rotatingFilesMu.Lock()
+	defer rotatingFilesMu.Unlock()
+	f, ok := rotatingFiles[path]
+	if !ok {
+		f = &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+		rotatingFiles[path] = f
+	}
+	return f
+}
+
+// write appends b, rotating beforehand if b would not fit. Must be called with f locked.
+func (f *rotatingFile) write(b []byte) error {
+	if f.file != nil && f.maxSize > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return errors.Wrap(err, "Could not rotate")
+		}
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		f.file, f.size = file, info.Size()
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if f.maxFiles < 1 {
+		return os.Remove(f.path)
+	}
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+type filePublisher struct {
+	file *rotatingFile
+}
+
+func (p filePublisher) Setup(context.Context) (chan []AccountInfo, chan int, error) {
+	input := make(chan []AccountInfo)
+	confirm := make(chan int, 1)
+	go writeLines(&p.file.Mutex, p.file.write, input, confirm)
+	return input, confirm, nil
+}
+
+type httpPublisher struct {
+	url    string
+	client http.Client
+}
+
+func (p httpPublisher) Setup(ctx context.Context) (chan []AccountInfo, chan int, error) {
+	input := make(chan []AccountInfo)
+	confirm := make(chan int, 1)
+	go func() {
+		defer close(confirm)
+		for ais := range input {
+			if err := p.post(ctx, ais); err != nil {
+				log.Errorf("Failed to publish samples: %v", err)
+				continue
+			}
+			confirm <- len(ais)
+		}
+	}()
+	return input, confirm, nil
+}
+
+func (p httpPublisher) post(ctx context.Context, ais []AccountInfo) error {
+	body, err := json.Marshal(ais)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode samples")
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Failed creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", gophercloud.DefaultUserAgent)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: unexpected status %s", p.url, resp.Status)
+	}
+	return nil
+}
+
+type fakePublisher struct{}
+
+func (fakePublisher) Setup(context.Context) (chan []AccountInfo, chan int, error) {
+	return fakeSetupRabbit()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
@@ -10,7 +12,7 @@ import (
 
 type rabbitPayload struct {
 	Args struct {
-		Data []AccountInfo `json:"data"`
+		Data interface{} `json:"data"`
 	} `json:"args"`
 }
 
@@ -22,9 +24,10 @@ func fakeSetupRabbit() (chan []AccountInfo, chan int, error) {
 		for ais := range input {
 			var size int64
 			for _, a := range ais {
+				// Ratios such as storage.quota.utilization are not sizes.
 				conso, err := strconv.ParseInt(a.CounterVolume, 10, 64)
 				if err != nil {
-					return
+					continue
 				}
 				size += conso
 			}
@@ -35,7 +38,28 @@ func fakeSetupRabbit() (chan []AccountInfo, chan int, error) {
 	return input, confirm, nil
 }
 
-func setupRabbit(rabbit rabbitCreds) (chan []AccountInfo, chan int, error) {
+// Delay before publishing again a chunk nacked by the broker, doubled on every attempt.
+const (
+	rabbitRetryDelay    = 200 * time.Millisecond
+	rabbitMaxRetryDelay = 5 * time.Second
+)
+
+type rabbitPublisher struct {
+	rabbit rabbitCreds
+	// Samples returned by the broker as unroutable, written by DeliverPayloads
+	// before it closes the confirm channel.
+	unroutable int
+}
+
+func (p *rabbitPublisher) Setup(ctx context.Context) (chan []AccountInfo, chan int, error) {
+	return setupRabbit(ctx, p.rabbit, &p.unroutable)
+}
+
+func (p *rabbitPublisher) Unroutable() int {
+	return p.unroutable
+}
+
+func setupRabbit(ctx context.Context, rabbit rabbitCreds, unroutable *int) (chan []AccountInfo, chan int, error) {
 	log.Debug("Connecting to: ", rabbit.URI)
 	conn, err := amqp.Dial(rabbit.URI)
 	if err != nil {
@@ -46,21 +70,45 @@ func setupRabbit(rabbit rabbitCreds) (chan []AccountInfo, chan int, error) {
 		return nil, nil, errors.Wrap(err, "Failed to open channel")
 	}
 
-	log.Debug("Checking existence or declaring exchange: ", rabbit.Exchange)
+	exchange, _ := rabbit.destination()
+	log.Debug("Checking existence or declaring exchange: ", exchange)
 	if err := ch.ExchangeDeclare(
-		rabbit.Exchange, // name of the exchange
-		"topic",         // type
-		false,           // durable
-		false,           // delete when complete
-		false,           // internal
-		false,           // noWait
-		nil,             // arguments
+		exchange, // name of the exchange
+		"topic",  // type
+		false,    // durable
+		false,    // delete when complete
+		false,    // internal
+		false,    // noWait
+		nil,      // arguments
 	); err != nil {
 		return nil, nil, errors.Wrap(err, "Failed declaring exchange")
 	}
 
+	// Notifications are left to the queues of their consumers: without any, the broker
+	// returns them as unroutable.
+	if rabbit.Mode != rabbitModeNotification {
+		if err := bindQueue(ch, rabbit); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	log.Debug("Putting channel in confirm mode")
+	if err := ch.Confirm(false); err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to put channel in confirm mode")
+	}
+
+	input := make(chan []AccountInfo)
+	confirm := make(chan int, 1)
+
+	go DeliverPayloads(ctx, rabbit, conn, ch, input, confirm, unroutable)
+
+	return input, confirm, nil
+}
+
+// bindQueue declares the collector queue and binds it to the exchange.
+func bindQueue(ch *amqp.Channel, rabbit rabbitCreds) error {
 	log.Debug("Checking existence or declaring queue: ", rabbit.Queue)
-	_, err = ch.QueueDeclare(
+	_, err := ch.QueueDeclare(
 		rabbit.Queue, // name of the queue
 		true,         // durable
 		false,        // delete when usused
@@ -69,7 +117,7 @@ func setupRabbit(rabbit rabbitCreds) (chan []AccountInfo, chan int, error) {
 		nil,          // arguments
 	)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Failed declaring queue")
+		return errors.Wrap(err, "Failed declaring queue")
 	}
 
 	log.Debug("Binding queue to exchange")
@@ -80,43 +128,97 @@ func setupRabbit(rabbit rabbitCreds) (chan []AccountInfo, chan int, error) {
 		false,             // noWait
 		nil,               // arguments
 	); err != nil {
-		return nil, nil, errors.Wrap(err, "Failed binding queue")
+		return errors.Wrap(err, "Failed binding queue")
 	}
-
-	input := make(chan []AccountInfo)
-	confirm := make(chan int, 1)
-
-	go DeliverPayloads(rabbit, conn, ch, input, confirm)
-
-	return input, confirm, nil
+	return nil
 }
 
-func DeliverPayloads(rabbit rabbitCreds, conn *amqp.Connection, ch *amqp.Channel, msgChan <-chan []AccountInfo, confirm chan int) {
+// DeliverPayloads publishes every chunk as a mandatory message and waits for the broker
+// to confirm it: only acked chunks are counted on confirm, returned ones are added to
+// unroutable and nacked ones are published again until ctx is done.
+func DeliverPayloads(ctx context.Context, rabbit rabbitCreds, conn *amqp.Connection, ch *amqp.Channel, msgChan <-chan []AccountInfo, confirm chan int, unroutable *int) {
 	defer ch.Close()     // clean-up
 	defer conn.Close()   // clean-up
 	defer close(confirm) // this signals the outer routine that job is done/canceled
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	// Set once a confirmation may be missing: the next ones could not be matched
+	// with their chunk, so the remaining chunks are dropped.
+	var broken error
 	for ais := range msgChan {
 		size := len(ais)
-		output := rabbitPayload{}
-		output.Args.Data = ais
-		rbMsg, err := json.Marshal(output)
+		if broken != nil {
+			log.Errorf("Failed to publish message: %v", broken)
+			continue
+		}
+		rbMsg, err := rabbitBody(rabbit, ais)
 		if err != nil {
 			log.Errorf("cannot parse rabbit payload: %v", err)
+			continue
 		}
 
-		err = ch.Publish(
-			rabbit.Exchange,   // exchange
-			rabbit.RoutingKey, // routing key
-			false,             // mandatory
-			false,             // immediate
-			amqp.Publishing{
-				ContentType: "application/json",
-				Body:        rbMsg,
-			})
-		if err != nil {
-			log.Errorf("Failed to publish message: %v", err)
-		} else {
-			confirm <- size
+		delay := rabbitRetryDelay
+		for {
+			acked, returned, err := publishConfirmed(ctx, rabbit, ch, confirms, returns, rbMsg)
+			if err != nil {
+				log.Errorf("Failed to publish message: %v", err)
+				broken = err
+				break
+			}
+			if returned {
+				exchange, routingKey := rabbit.destination()
+				log.Errorf("Broker could not route %d samples to %s with key %s", size, exchange, routingKey)
+				*unroutable += size
+				break
+			}
+			if acked {
+				confirm <- size
+				break
+			}
+			log.Warnf("Broker nacked %d samples, publishing them again in %v", size, delay)
+			select {
+			case <-ctx.Done():
+				log.Errorf("Failed to publish message: %v", ctx.Err())
+			case <-time.After(delay):
+				delay *= 2
+				if delay > rabbitMaxRetryDelay {
+					delay = rabbitMaxRetryDelay
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// publishConfirmed publishes body and waits for its confirmation. The broker sends the
+// basic.return of an unroutable message before acking it.
+func publishConfirmed(ctx context.Context, rabbit rabbitCreds, ch *amqp.Channel, confirms <-chan amqp.Confirmation, returns <-chan amqp.Return, body []byte) (acked, returned bool, err error) {
+	exchange, routingKey := rabbit.destination()
+	err = ch.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        body,
+		})
+	if err != nil {
+		return false, false, err
+	}
+	select {
+	case c, ok := <-confirms:
+		if !ok {
+			return false, false, fmt.Errorf("channel closed before the broker confirmed")
+		}
+		select {
+		case _, ok := <-returns:
+			returned = ok
+		default:
 		}
+		return c.Ack, returned, nil
+	case <-ctx.Done():
+		return false, false, errors.Wrap(ctx.Err(), "No confirmation from the broker")
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/marpaia/graphite-golang"
+	"github.com/pkg/errors"
+)
+
+// reconReport sums what the recon middleware of the storage nodes of a region reports.
+type reconReport struct {
+	Nodes      int
+	Errors     int   // nodes that could not be queried
+	Capacity   int64 // bytes of the mounted devices
+	Used       int64
+	Free       int64
+	Devices    int
+	Unmounted  int
+	Quarantine map[string]int64 // quarantined objects, accounts and containers
+	// Replication of objects: longest pass and age of the oldest completed pass.
+	ReplicationTime float64
+	ReplicationAge  time.Duration
+}
+
+type reconDisk struct {
+	Device  string      `json:"device"`
+	Mounted interface{} `json:"mounted"` // false, true or the error of an unreadable mount
+	Size    interface{} `json:"size"`    // "" when unmounted
+	Used    interface{} `json:"used"`
+	Avail   interface{} `json:"avail"`
+}
+
+type reconReplication struct {
+	// Minutes of the last pass.
+	ReplicationTime float64 `json:"replication_time"`
+	// Unix time at which the last pass completed.
+	ReplicationLast float64 `json:"replication_last"`
+}
+
+// reconInt reads a recon number, which is missing or "" for unmounted devices.
+func reconInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// reconHosts returns the storage nodes listed in nodes, or holding a device of the ring.
+// Every node is queried once on its lowest port: with servers_per_port each device has
+// its own port, and the recon of any of them covers every disk of the node.
+func reconHosts(nodes []string, ringPath string) ([]string, error) {
+	if len(nodes) > 0 || ringPath == "" {
+		return nodes, nil
+	}
+	ring, err := loadRing(ringPath, ringConfig{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not load ring %s", ringPath)
+	}
+	ports := make(map[string]int)
+	for _, dev := range ring.devs {
+		if dev == nil {
+			continue
+		}
+		if port, ok := ports[dev.IP]; !ok || dev.Port < port {
+			ports[dev.IP] = dev.Port
+		}
+	}
+	var hosts []string
+	for ip, port := range ports {
+		hosts = append(hosts, joinHostPort(ip, port))
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// pollRecon queries the diskusage, quarantined and replication recon endpoints of every host.
+func pollRecon(ctx context.Context, hosts []string, requestTimeout time.Duration) reconReport {
+	client := http.Client{Timeout: requestTimeout}
+	report := reconReport{Nodes: len(hosts), Quarantine: make(map[string]int64)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	now := time.Now()
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			var disks []reconDisk
+			quarantined := make(map[string]interface{})
+			var replication reconReplication
+			err := reconGet(ctx, &client, host, "diskusage", &disks)
+			if err == nil {
+				err = reconGet(ctx, &client, host, "quarantined", &quarantined)
+			}
+			if err == nil {
+				err = reconGet(ctx, &client, host, "replication/object", &replication)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Errorf("cannot get recon of %s: %v", host, err)
+				report.Errors++
+				return
+			}
+			for _, d := range disks {
+				report.Devices++
+				if mounted, _ := d.Mounted.(bool); !mounted {
+					report.Unmounted++
+					continue
+				}
+				report.Capacity += reconInt(d.Size)
+				report.Used += reconInt(d.Used)
+				report.Free += reconInt(d.Avail)
+			}
+			for _, kind := range []string{"objects", "accounts", "containers"} {
+				report.Quarantine[kind] += reconInt(quarantined[kind])
+			}
+			if replication.ReplicationTime > report.ReplicationTime {
+				report.ReplicationTime = replication.ReplicationTime
+			}
+			if replication.ReplicationLast > 0 {
+				age := now.Sub(time.Unix(int64(replication.ReplicationLast), 0))
+				if age > report.ReplicationAge {
+					report.ReplicationAge = age
+				}
+			}
+		}(host)
+	}
+	wg.Wait()
+	return report
+}
+
+func reconGet(ctx context.Context, client *http.Client, host, check string, v interface{}) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/recon/%s", host, check), nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed creating request")
+	}
+	req.Header.Set("User-Agent", gophercloud.DefaultUserAgent)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /recon/%s: unexpected status %s", check, resp.Status)
+	}
+	return errors.Wrapf(json.Unmarshal(body, v), "Could not parse /recon/%s", check)
+}
+
+// Publish sends the recon totals of the region. billed is the sum of the bytes used by
+// the accounts, 0 when unknown, from which the replica overhead is derived.
+func (r reconReport) Publish(gf *graphite.Graphite, region string, billed int64) {
+	gf.SimpleSend(fmt.Sprintf("%v.recon.nodes", region), fmt.Sprintf("%d", r.Nodes))
+	gf.SimpleSend(fmt.Sprintf("%v.recon.errors", region), fmt.Sprintf("%d", r.Errors))
+	gf.SimpleSend(fmt.Sprintf("%v.recon.devices", region), fmt.Sprintf("%d", r.Devices))
+	gf.SimpleSend(fmt.Sprintf("%v.recon.unmounted", region), fmt.Sprintf("%d", r.Unmounted))
+	gf.SimpleSend(fmt.Sprintf("%v.recon.capacity", region), fmt.Sprintf("%d", r.Capacity))
+	gf.SimpleSend(fmt.Sprintf("%v.recon.used", region), fmt.Sprintf("%d", r.Used))
+	gf.SimpleSend(fmt.Sprintf("%v.recon.free", region), fmt.Sprintf("%d", r.Free))
+	for kind, n := range r.Quarantine {
+		gf.SimpleSend(fmt.Sprintf("%v.recon.quarantined.%v", region, kind), fmt.Sprintf("%d", n))
+	}
+	gf.SimpleSend(fmt.Sprintf("%v.recon.replication.time", region), fmt.Sprintf("%.2f", r.ReplicationTime))
+	gf.SimpleSend(fmt.Sprintf("%v.recon.replication.age", region), fmt.Sprintf("%d", int(r.ReplicationAge.Seconds())))
+	if billed > 0 && r.Errors == 0 {
+		gf.SimpleSend(fmt.Sprintf("%v.recon.overhead", region), fmt.Sprintf("%.4f", float64(r.Used)/float64(billed)))
+	}
+}
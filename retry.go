@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/pkg/errors"
+)
+
+// Classes of outcome of an account HEAD, reported separately in RegionReport.
+const (
+	failureNotFound     = "notfound"     // account never created, emitted as zero usage
+	failureUnauthorized = "unauthorized" // token rejected even after re-authentication
+	failureServer       = "server"       // 5xx and 429
+	failureTimeout      = "timeout"
+	failureConnection   = "connection"
+	failureOther        = "other"
+)
+
+var failureClasses = []string{failureNotFound, failureUnauthorized, failureServer, failureTimeout, failureConnection, failureOther}
+
+// retryPolicy configures how account HEADs are retried.
+type retryPolicy struct {
+	Attempts       int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	RequestTimeout time.Duration
+}
+
+// backoff returns the delay before retry number attempt (starting at 1):
+// exponential growth capped to MaxDelay, with full jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << uint(attempt-1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+func classify(status int, err error) string {
+	if status == 0 {
+		if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+			return failureTimeout
+		}
+		return failureConnection
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return failureNotFound
+	case status == http.StatusUnauthorized:
+		return failureUnauthorized
+	case status == 429 || status >= 500:
+		return failureServer
+	}
+	return failureOther
+}
+
+func retryable(class string) bool {
+	switch class {
+	case failureServer, failureTimeout, failureConnection:
+		return true
+	}
+	return false
+}
+
+// headAccount sends a HEAD request on accountURL, retrying according to policy.
+// With newest, the proxy answers from the newest replica instead of the first one.
+// On failure it returns the class of the last error.
+// The request is cancelled when ctx is done.
+func headAccount(ctx context.Context, accountURL string, newest bool, policy retryPolicy, sess *session,
+	ctl *concurrencyController) (http.Header, string, error) {
+
+	client := sess.httpClient
+	client.Timeout = policy.RequestTimeout
+
+	resp, class, err := sendWithRetry(ctx, policy, ctl, func() (*http.Response, error) {
+		req, err := newSwiftRequest(ctx, "HEAD", accountURL)
+		if err != nil {
+			return nil, err
+		}
+		if newest {
+			req.Header.Set("X-Newest", "true")
+		}
+		return sess.do(req, &client)
+	})
+	if err != nil {
+		return nil, class, err
+	}
+	resp.Body.Close()
+	return resp.Header, "", nil
+}
+
+// sendWithRetry calls send until it gets a 2xx response, retrying according to policy.
+// On success the caller must close the response body. On failure it returns the class
+// of the last error.
+func sendWithRetry(ctx context.Context, policy retryPolicy, ctl *concurrencyController,
+	send func() (*http.Response, error)) (*http.Response, string, error) {
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, err := send()
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+		}
+		ctl.observe(status, time.Since(start))
+		if status >= 200 && status < 300 {
+			return resp, "", nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s %s: unexpected status %s", resp.Request.Method, resp.Request.URL, resp.Status)
+		}
+
+		class := classify(status, err)
+		if !retryable(class) || attempt >= policy.Attempts || ctx.Err() != nil {
+			return nil, class, err
+		}
+		log.Debugf("%v (%s), retrying", err, class)
+		select {
+		case <-ctx.Done():
+			return nil, class, err
+		case <-time.After(policy.backoff(attempt)):
+		}
+	}
+}
+
+// newSwiftRequest returns a request cancelled when ctx is done, to be sent with session.do.
+func newSwiftRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed creating request")
+	}
+	req.Header.Set("User-Agent", gophercloud.DefaultUserAgent)
+	return req.WithContext(ctx), nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/pkg/errors"
+)
+
+// Backends serving the accounts of a region.
+const (
+	backendSwift = "swift"
+	backendRGW   = "rgw" // ceph radosgw, polled through its admin API
+)
+
+// rgwConfig holds the settings of the radosgw admin API.
+type rgwConfig struct {
+	AccessKey string
+	SecretKey string
+	AdminPath string // path of the admin API, "admin" unless changed in rgw_admin_entry
+	// With rgw_keystone_implicit_tenants, users of keystone projects are named <project>$<project>.
+	ImplicitTenants bool
+}
+
+// rgwClient sends signed requests to the admin API of one radosgw endpoint.
+type rgwClient struct {
+	endpoint string
+	conf     rgwConfig
+	client   http.Client
+}
+
+func newRGWClient(endpoint string, conf rgwConfig, requestTimeout time.Duration) *rgwClient {
+	return &rgwClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		conf:     conf,
+		client:   http.Client{Timeout: requestTimeout},
+	}
+}
+
+// uid returns the radosgw user owning the buckets of account.
+func (c *rgwClient) uid(account Account) string {
+	if c.conf.ImplicitTenants {
+		return account.Name + "$" + account.Name
+	}
+	return account.Name
+}
+
+// distinctUsers keeps the first account of every radosgw user. Reseller prefixes do not
+// map to users: the accounts of a project under each prefix would share its buckets.
+func (c *rgwClient) distinctUsers(accounts []Account) []Account {
+	seen := make(map[string]bool)
+	var distinct []Account
+	for _, account := range accounts {
+		uid := c.uid(account)
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		distinct = append(distinct, account)
+	}
+	return distinct
+}
+
+// newRequest returns a GET on the admin resource, signed with the S3 v2 scheme.
+// Admin requests are signed without their query string.
+func (c *rgwClient) newRequest(ctx context.Context, resource string, query url.Values) (*http.Request, error) {
+	path := "/" + strings.Trim(c.conf.AdminPath, "/") + "/" + resource
+	req, err := http.NewRequest("GET", c.endpoint+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed creating request")
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	mac := hmac.New(sha1.New, []byte(c.conf.SecretKey))
+	mac.Write([]byte("GET\n\n\n" + date + "\n" + path))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Date", date)
+	req.Header.Set("Authorization", "AWS "+c.conf.AccessKey+":"+signature)
+	req.Header.Set("User-Agent", gophercloud.DefaultUserAgent)
+	return req.WithContext(ctx), nil
+}
+
+// get decodes the JSON answer of an admin resource into v, retrying according to policy.
+func (c *rgwClient) get(ctx context.Context, resource string, query url.Values, v interface{},
+	policy retryPolicy, ctl *concurrencyController) (string, error) {
+
+	resp, class, err := sendWithRetry(ctx, policy, ctl, func() (*http.Response, error) {
+		req, err := c.newRequest(ctx, resource, query)
+		if err != nil {
+			return nil, err
+		}
+		return c.client.Do(req)
+	})
+	if err != nil {
+		return class, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return failureConnection, errors.Wrapf(err, "Could not read %s", resource)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return failureOther, errors.Wrapf(err, "Could not parse %s", resource)
+	}
+	return "", nil
+}
+
+// rgwBucket is one entry of the bucket stats of a user.
+type rgwBucket struct {
+	Bucket        string `json:"bucket"`
+	PlacementRule string `json:"placement_rule"`
+	Usage         map[string]struct {
+		Size       int64 `json:"size"`
+		SizeKB     int64 `json:"size_kb"`
+		NumObjects int64 `json:"num_objects"`
+	} `json:"usage"`
+}
+
+// stats returns the bytes and objects of the bucket. Only the rgw.main category holds
+// objects: the others account for multipart uploads in progress and the like.
+func (b rgwBucket) stats() (bytes, objects int64) {
+	main := b.Usage["rgw.main"]
+	bytes = main.Size
+	if bytes == 0 {
+		// Releases before Jewel only report the size in KiB.
+		bytes = main.SizeKB * 1024
+	}
+	return bytes, main.NumObjects
+}
+
+// rgwUsage is the usage log summary of a user.
+type rgwUsage struct {
+	Summary []struct {
+		Total struct {
+			BytesSent     int64 `json:"bytes_sent"`
+			BytesReceived int64 `json:"bytes_received"`
+			Ops           int64 `json:"ops"`
+		} `json:"total"`
+	} `json:"summary"`
+}
+
+// rgwValues maps the meters to the bucket stats they sum.
+var rgwValues = map[string]func(b rgwBucket) int64{
+	"storage.objects.size":       func(b rgwBucket) int64 { bytes, _ := b.stats(); return bytes },
+	"storage.objects":            func(b rgwBucket) int64 { _, objects := b.stats(); return objects },
+	"storage.objects.containers": func(rgwBucket) int64 { return 1 },
+}
+
+// pollRGWAccount returns the samples of an account served by radosgw. They are built
+// from the bucket stats of its user, placement rules standing for storage policies.
+// The totals of the usage log are added to the metadata of the samples.
+func pollRGWAccount(ctx context.Context, cfg *RegionPollConfig, account Account,
+	ctl *concurrencyController) ([]AccountInfo, string, error) {
+
+	project := account.Project
+	uid := cfg.rgw.uid(account)
+	var buckets []rgwBucket
+	class, err := cfg.rgw.get(ctx, "bucket", url.Values{"uid": {uid}, "stats": {"true"}, "format": {"json"}},
+		&buckets, cfg.retry, ctl)
+	var ais []AccountInfo
+	switch {
+	case class == failureNotFound:
+		log.Debug("RGW user not found: ", uid)
+		if account.Primary {
+			for _, m := range cfg.meters {
+				ais = append(ais, newSample(m, project, cfg.region, "0"))
+			}
+		}
+		tagAccount(ais, account)
+		return ais, class, nil
+	case err != nil && ctx.Err() != nil:
+		return nil, class, err
+	case err != nil:
+		log.Errorf("RGW user %s: %v", uid, err)
+		return nil, class, err
+	}
+
+	var usage rgwUsage
+	class, err = cfg.rgw.get(ctx, "usage", url.Values{"uid": {uid}, "show_entries": {"false"}, "format": {"json"}},
+		&usage, cfg.retry, ctl)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("RGW user %s: %v", uid, err)
+		}
+		return nil, class, err
+	}
+	metadata := map[string]string{"bytes_sent": "0", "bytes_received": "0", "ops": "0"}
+	if len(usage.Summary) > 0 {
+		total := usage.Summary[0].Total
+		metadata["bytes_sent"] = strconv.FormatInt(total.BytesSent, 10)
+		metadata["bytes_received"] = strconv.FormatInt(total.BytesReceived, 10)
+		metadata["ops"] = strconv.FormatInt(total.Ops, 10)
+	}
+
+	policies := make(map[string][]rgwBucket)
+	for _, b := range buckets {
+		if b.PlacementRule != "" {
+			policies[b.PlacementRule] = append(policies[b.PlacementRule], b)
+		}
+	}
+	var names []string
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, m := range cfg.meters {
+		ai := newSample(m, project, cfg.region, fmt.Sprint(sumBuckets(buckets, rgwValues[m.Name])))
+		ai.ResourceMetadata = copyMetadata(metadata)
+		ais = append(ais, ai)
+		for _, name := range names {
+			ai := newSample(m, project, cfg.region, fmt.Sprint(sumBuckets(policies[name], rgwValues[m.Name])))
+			ai.CounterName = m.PolicyName
+			ai.ResourceMetadata = map[string]string{"storage_policy": name}
+			ais = append(ais, ai)
+		}
+	}
+
+	if cfg.containers.wants(project) {
+		var containers []containerInfo
+		for _, b := range buckets {
+			bytes, objects := b.stats()
+			containers = append(containers, containerInfo{Name: b.Bucket, Count: objects, Bytes: bytes})
+		}
+		ais = append(ais, containerSamples(containers, project, cfg.region)...)
+	}
+	tagAccount(ais, account)
+	return ais, "", nil
+}
+
+func sumBuckets(buckets []rgwBucket, value func(rgwBucket) int64) int64 {
+	var sum int64
+	for _, b := range buckets {
+		sum += value(b)
+	}
+	return sum
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
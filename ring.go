@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/pkg/errors"
+)
+
+const backendRing = "ring" // swift account servers, found with the account ring
+
+// How the answers of the replicas of an account are reconciled.
+const (
+	ringAnswerMajority = "majority"
+	ringAnswerNewest   = "newest"
+)
+
+// ringConfig holds the settings of direct account server polling.
+type ringConfig struct {
+	// swift_hash_path_prefix and swift_hash_path_suffix of /etc/swift/swift.conf.
+	HashPathPrefix string
+	HashPathSuffix string
+	Answer         string
+}
+
+type ringDevice struct {
+	ID     int    `json:"id"`
+	IP     string `json:"ip"`
+	Port   int    `json:"port"`
+	Device string `json:"device"`
+}
+
+// accountRing maps account names to the devices holding their replicas.
+type accountRing struct {
+	devs               []*ringDevice // indexed by id, nil for removed devices
+	partShift          uint
+	replica2part2devID [][]int
+	conf               ringConfig
+}
+
+// loadRing reads a ring file, either in the JSON format written since swift 2.3
+// or as a gzipped pickle written by older releases.
+func loadRing(path string, conf ringConfig) (*accountRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not decompress ring")
+	}
+	defer gz.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(gz, magic); err != nil {
+		return nil, errors.Wrap(err, "Could not read ring")
+	}
+	var ring *accountRing
+	if string(magic) == "R1NG" {
+		ring, err = readJSONRing(gz)
+	} else {
+		ring, err = readPickleRing(io.MultiReader(bytes.NewReader(magic), gz))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse ring")
+	}
+	ring.conf = conf
+	return ring, nil
+}
+
+// readJSONRing reads a version 1 ring: a JSON header followed by one array of
+// 2 bytes device ids per replica, the last one being shorter for fractional replicas.
+func readJSONRing(r io.Reader) (*accountRing, error) {
+	var header struct {
+		Version uint16
+		Length  uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported ring format version %d", header.Version)
+	}
+	var meta struct {
+		Devs         []*ringDevice `json:"devs"`
+		PartShift    uint          `json:"part_shift"`
+		ReplicaCount int           `json:"replica_count"`
+		ByteOrder    string        `json:"byteorder"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r, int64(header.Length))).Decode(&meta); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if meta.ByteOrder == "big" {
+		order = binary.BigEndian
+	}
+	ring := &accountRing{devs: meta.Devs, partShift: meta.PartShift}
+	partitions := 1 << (32 - meta.PartShift)
+	for i := 0; i < meta.ReplicaCount; i++ {
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(2*partitions)))
+		if err != nil {
+			return nil, err
+		}
+		part2dev := make([]int, len(b)/2)
+		for p := range part2dev {
+			part2dev[p] = int(order.Uint16(b[2*p:]))
+		}
+		ring.replica2part2devID = append(ring.replica2part2devID, part2dev)
+	}
+	return ring, nil
+}
+
+// readPickleRing reads the dict pickled by RingData.save before the JSON format.
+func readPickleRing(r io.Reader) (*accountRing, error) {
+	v, err := unpickle(r)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expecting a dict, got %T", v)
+	}
+	ring := &accountRing{}
+	shift, ok := data["part_shift"].(int64)
+	if !ok {
+		return nil, fmt.Errorf("missing part_shift")
+	}
+	ring.partShift = uint(shift)
+	replicas, _ := data["replica2part2dev_id"].([]interface{})
+	for _, replica := range replicas {
+		part2dev, ok := replica.([]int)
+		if !ok {
+			return nil, fmt.Errorf("expecting arrays in replica2part2dev_id, got %T", replica)
+		}
+		ring.replica2part2devID = append(ring.replica2part2devID, part2dev)
+	}
+	devs, _ := data["devs"].([]interface{})
+	for _, d := range devs {
+		dev, ok := d.(map[string]interface{})
+		if !ok {
+			ring.devs = append(ring.devs, nil)
+			continue
+		}
+		id, _ := dev["id"].(int64)
+		port, _ := dev["port"].(int64)
+		ip, _ := dev["ip"].(string)
+		device, _ := dev["device"].(string)
+		ring.devs = append(ring.devs, &ringDevice{ID: int(id), IP: ip, Port: int(port), Device: device})
+	}
+	return ring, nil
+}
+
+// partition returns the partition of account, as swift's hash_path does.
+func (r *accountRing) partition(account string) int {
+	sum := md5.Sum([]byte(r.conf.HashPathPrefix + "/" + account + r.conf.HashPathSuffix))
+	return int(binary.BigEndian.Uint32(sum[:4]) >> r.partShift)
+}
+
+// accountURLs returns the URLs of the replicas of account on the account servers.
+func (r *accountRing) accountURLs(account string) []string {
+	part := r.partition(account)
+	seen := make(map[int]bool)
+	var urls []string
+	for _, part2dev := range r.replica2part2devID {
+		if part >= len(part2dev) {
+			continue
+		}
+		id := part2dev[part]
+		if seen[id] || id >= len(r.devs) || r.devs[id] == nil {
+			continue
+		}
+		seen[id] = true
+		dev := r.devs[id]
+		urls = append(urls, fmt.Sprintf("http://%s/%s/%d/%s",
+			joinHostPort(dev.IP, dev.Port), dev.Device, part, url.PathEscape(account)))
+	}
+	return urls
+}
+
+func joinHostPort(ip string, port int) string {
+	if strings.Contains(ip, ":") {
+		return "[" + ip + "]:" + strconv.Itoa(port)
+	}
+	return ip + ":" + strconv.Itoa(port)
+}
+
+// replicaAnswer is the outcome of the HEAD of one replica.
+type replicaAnswer struct {
+	header http.Header
+	class  string
+	err    error
+}
+
+// headAccountReplicas sends a HEAD to every replica of account and reconciles their answers.
+// Account servers do not check tokens.
+func headAccountReplicas(ctx context.Context, ring *accountRing, account string, policy retryPolicy,
+	ctl *concurrencyController) (http.Header, string, error) {
+
+	urls := ring.accountURLs(account)
+	if len(urls) == 0 {
+		return nil, failureOther, fmt.Errorf("no device for account %s in the ring", account)
+	}
+	client := http.Client{Timeout: policy.RequestTimeout}
+	answers := make(chan replicaAnswer, len(urls))
+	for _, u := range urls {
+		go func(u string) {
+			resp, class, err := sendWithRetry(ctx, policy, ctl, func() (*http.Response, error) {
+				req, err := http.NewRequest("HEAD", u, nil)
+				if err != nil {
+					return nil, err
+				}
+				req.Header.Set("User-Agent", gophercloud.DefaultUserAgent)
+				return client.Do(req.WithContext(ctx))
+			})
+			if err != nil {
+				answers <- replicaAnswer{class: class, err: err}
+				return
+			}
+			resp.Body.Close()
+			answers <- replicaAnswer{header: resp.Header}
+		}(u)
+	}
+	var all []replicaAnswer
+	for range urls {
+		all = append(all, <-answers)
+	}
+	return reconcile(all, ring.conf.Answer)
+}
+
+// reconcile picks the answer of an account among the answers of its replicas.
+// A missing account needs a majority of not found answers: like the proxy, a minority
+// of them without any replica found is an error. Otherwise the answer is
+// either the usage reported by a majority of replicas, or that of the replica with
+// the newest put timestamp, which majority also falls back to without majority.
+func reconcile(answers []replicaAnswer, mode string) (http.Header, string, error) {
+	var found []http.Header
+	notFound := 0
+	var firstErr replicaAnswer
+	for _, a := range answers {
+		switch {
+		case a.err == nil:
+			found = append(found, a.header)
+		case a.class == failureNotFound:
+			notFound++
+		case firstErr.err == nil:
+			firstErr = a
+		}
+	}
+	quorum := len(answers)/2 + 1
+	if notFound >= quorum {
+		return nil, failureNotFound, fmt.Errorf("account not found on %d of %d replicas", notFound, len(answers))
+	}
+	if len(found) == 0 {
+		return nil, firstErr.class, firstErr.err
+	}
+
+	if mode == ringAnswerMajority {
+		counts := make(map[string]int)
+		for _, h := range found {
+			key := usageKey(h)
+			counts[key]++
+			if counts[key] >= quorum {
+				return h, "", nil
+			}
+		}
+		log.Debugf("No majority among %d replicas, using the newest", len(answers))
+	}
+	newest := found[0]
+	for _, h := range found[1:] {
+		if putTimestamp(h) > putTimestamp(newest) {
+			newest = h
+		}
+	}
+	return newest, "", nil
+}
+
+func usageKey(h http.Header) string {
+	return strings.Join([]string{h.Get("X-Account-Bytes-Used"), h.Get("X-Account-Object-Count"),
+		h.Get("X-Account-Container-Count")}, "/")
+}
+
+func putTimestamp(h http.Header) float64 {
+	ts, err := strconv.ParseFloat(h.Get("X-Put-Timestamp"), 64)
+	if err != nil {
+		ts, _ = strconv.ParseFloat(h.Get("X-Timestamp"), 64)
+	}
+	return ts
+}
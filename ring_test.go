@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// The rings of testdata are written by testdata/make_rings.py in every format swift
+// saved them: partition power 4, 3 replicas and a removed device. The expected
+// partitions come from swift's hash_path with the same prefix and suffix.
+func TestLoadRing(t *testing.T) {
+	files := []string{
+		"testdata/account-py2-protocol2.ring.gz",
+		"testdata/account-py3-protocol2.ring.gz",
+		"testdata/account-py3-protocol3.ring.gz",
+		"testdata/account-py3-protocol4.ring.gz",
+		"testdata/account-json.ring.gz",
+	}
+	accounts := []struct {
+		account   string
+		partition int
+		urls      []string
+	}{
+		{"AUTH_d5bbc7c06c9e479dbb91912c045cdeab", 5, []string{
+			"http://[fd00::3]:6012/sdc/5/AUTH_d5bbc7c06c9e479dbb91912c045cdeab",
+			"http://10.0.0.1:6202/sda/5/AUTH_d5bbc7c06c9e479dbb91912c045cdeab",
+			"http://10.0.0.2:6202/sdb/5/AUTH_d5bbc7c06c9e479dbb91912c045cdeab",
+		}},
+		{"AUTH_test", 7, []string{
+			"http://10.0.0.2:6202/sdb/7/AUTH_test",
+			"http://[fd00::3]:6012/sdc/7/AUTH_test",
+			"http://10.0.0.1:6202/sda/7/AUTH_test",
+		}},
+		{"AUTH_0f9c", 14, []string{
+			"http://[fd00::3]:6012/sdc/14/AUTH_0f9c",
+			"http://10.0.0.1:6202/sda/14/AUTH_0f9c",
+			"http://10.0.0.2:6202/sdb/14/AUTH_0f9c",
+		}},
+		{"SERVICE_a b", 5, []string{
+			"http://[fd00::3]:6012/sdc/5/SERVICE_a%20b",
+			"http://10.0.0.1:6202/sda/5/SERVICE_a%20b",
+			"http://10.0.0.2:6202/sdb/5/SERVICE_a%20b",
+		}},
+	}
+	wantDevs := []*ringDevice{
+		{ID: 0, IP: "10.0.0.1", Port: 6202, Device: "sda"},
+		{ID: 1, IP: "10.0.0.2", Port: 6202, Device: "sdb"},
+		nil,
+		{ID: 3, IP: "fd00::3", Port: 6012, Device: "sdc"},
+	}
+
+	for _, file := range files {
+		ring, err := loadRing(file, ringConfig{HashPathPrefix: "pre", HashPathSuffix: "suf"})
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if ring.partShift != 28 {
+			t.Errorf("%s: part shift %d, want 28", file, ring.partShift)
+		}
+		if len(ring.replica2part2devID) != 3 || len(ring.replica2part2devID[0]) != 16 {
+			t.Errorf("%s: %d replicas of %d partitions, want 3 of 16", file,
+				len(ring.replica2part2devID), len(ring.replica2part2devID[0]))
+		}
+		if !reflect.DeepEqual(ring.devs, wantDevs) {
+			t.Errorf("%s: devices %v, want %v", file, ring.devs, wantDevs)
+		}
+		for _, a := range accounts {
+			if part := ring.partition(a.account); part != a.partition {
+				t.Errorf("%s: partition of %s is %d, want %d", file, a.account, part, a.partition)
+			}
+			if urls := ring.accountURLs(a.account); !reflect.DeepEqual(urls, a.urls) {
+				t.Errorf("%s: URLs of %s are %v, want %v", file, a.account, urls, a.urls)
+			}
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	usage := func(bytes, putTimestamp string) replicaAnswer {
+		return replicaAnswer{header: http.Header{
+			"X-Account-Bytes-Used":      {bytes},
+			"X-Account-Object-Count":    {"1"},
+			"X-Account-Container-Count": {"1"},
+			"X-Put-Timestamp":           {putTimestamp},
+		}}
+	}
+	notFound := replicaAnswer{class: failureNotFound, err: errors.New("404 Not Found")}
+	timeout := replicaAnswer{class: failureTimeout, err: errors.New("timeout")}
+	server := replicaAnswer{class: failureServer, err: errors.New("503 Service Unavailable")}
+
+	tests := []struct {
+		name    string
+		answers []replicaAnswer
+		mode    string
+		class   string
+		bytes   string // X-Account-Bytes-Used of the answer, when found
+	}{
+		{"all found", []replicaAnswer{usage("10", "1"), usage("10", "1"), usage("10", "1")}, ringAnswerMajority, "", "10"},
+		{"one not found and timeouts", []replicaAnswer{notFound, timeout, timeout}, ringAnswerMajority, failureTimeout, ""},
+		{"one not found and server error", []replicaAnswer{server, notFound, timeout}, ringAnswerMajority, failureServer, ""},
+		{"not found by a majority", []replicaAnswer{notFound, usage("10", "1"), notFound}, ringAnswerMajority, failureNotFound, ""},
+		{"not found by a minority", []replicaAnswer{notFound, usage("10", "1"), timeout}, ringAnswerMajority, "", "10"},
+		{"majority", []replicaAnswer{usage("10", "1"), usage("20", "2"), usage("10", "1")}, ringAnswerMajority, "", "10"},
+		{"no majority falls back to newest", []replicaAnswer{usage("10", "1"), usage("30", "3"), usage("20", "2")}, ringAnswerMajority, "", "30"},
+		{"newest", []replicaAnswer{usage("10", "1"), usage("20", "2"), usage("10", "1")}, ringAnswerNewest, "", "20"},
+	}
+	for _, test := range tests {
+		header, class, err := reconcile(test.answers, test.mode)
+		if class != test.class {
+			t.Errorf("%s: class %q, want %q", test.name, class, test.class)
+		}
+		if test.bytes == "" {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if bytes := header.Get("X-Account-Bytes-Used"); bytes != test.bytes {
+			t.Errorf("%s: %s bytes used, want %s", test.name, bytes, test.bytes)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+"""Writes the account rings of ring_test.go the way swift's RingData.save does.
+
+Run with python2 for the pickle written by python 2, and with python3 for the
+others:
+
+    python2 make_rings.py && python3 make_rings.py
+"""
+import array
+import gzip
+import json
+import pickle
+import struct
+import sys
+
+PART_POWER = 4
+REPLICAS = 3
+
+devs = [
+    {'id': 0, 'ip': '10.0.0.1', 'port': 6202, 'device': 'sda', 'zone': 1, 'weight': 100.0},
+    {'id': 1, 'ip': '10.0.0.2', 'port': 6202, 'device': 'sdb', 'zone': 2, 'weight': 100.0},
+    None,  # removed device
+    {'id': 3, 'ip': 'fd00::3', 'port': 6012, 'device': 'sdc', 'zone': 3, 'weight': 100.0},
+]
+live = [0, 1, 3]
+replica2part2dev_id = [
+    array.array('H', [live[(part + r) % len(live)] for part in range(2 ** PART_POWER)])
+    for r in range(REPLICAS)]
+ring = {'devs': devs, 'part_shift': 32 - PART_POWER,
+        'replica2part2dev_id': replica2part2dev_id}
+
+
+def save_pickle(path, protocol):
+    with gzip.GzipFile(path, 'wb', mtime=0) as f:
+        pickle.dump(ring, f, protocol=protocol)
+
+
+def save_json(path):
+    meta = json.dumps({'devs': devs, 'part_shift': ring['part_shift'],
+                       'replica_count': REPLICAS, 'byteorder': sys.byteorder})
+    with gzip.GzipFile(path, 'wb', mtime=0) as f:
+        f.write(b'R1NG')
+        f.write(struct.pack('!HI', 1, len(meta)))
+        f.write(meta.encode('ascii'))
+        for part2dev in replica2part2dev_id:
+            f.write(part2dev.tostring() if sys.version_info[0] < 3 else part2dev.tobytes())
+
+
+if sys.version_info[0] < 3:
+    save_pickle('account-py2-protocol2.ring.gz', 2)
+else:
+    for protocol in (2, 3, 4):
+        save_pickle('account-py3-protocol%d.ring.gz' % protocol, protocol)
+    save_json('account-json.ring.gz')